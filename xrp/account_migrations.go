@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/shopspring/decimal"
+	"log"
+)
+
+// accountSchemaVersion is the version of the Account records written by this backend. Bump it
+// together with a new entry in accountMigrations whenever the stored shape changes.
+const accountSchemaVersion = 2
+
+// accountMigrations[i] upgrades a stored account record from schema version i to i+1. Migrations
+// work on the raw JSON object so they can handle fields the Account struct no longer has.
+var accountMigrations = []func(record map[string]interface{}) error{
+	migrateAccountV0,
+	migrateAccountV1,
+}
+
+// Version 0 records were written before records carried a version: the private key was stored
+// next to the seed, the key type was implicitly secp256k1 and the spend limit could be empty.
+func migrateAccountV0(record map[string]interface{}) error {
+	if keyType, _ := record["key_type"].(string); keyType == "" {
+		record["key_type"] = keyTypeSecp256k1
+	}
+	if secret, _ := record["secret"].(string); secret != "" {
+		delete(record, "private_key")
+	}
+	if txSpendLimit, _ := record["tx_spend_limit"].(string); txSpendLimit == "" {
+		record["tx_spend_limit"] = "0"
+	}
+	return nil
+}
+
+// Version 1 records keyed currency limits and approval thresholds by the currency code as it was typed, so
+// the hex form of USD did not match payments in USD. The keys are normalized; where two keys name the same
+// currency the lower limit is kept.
+func migrateAccountV1(record map[string]interface{}) error {
+	limits, _ := record["currency_spend_limits"].(map[string]interface{})
+	err := normalizeLimitKeys(limits)
+	if err != nil {
+		return err
+	}
+	policy, _ := record["approval_policy"].(map[string]interface{})
+	thresholds, _ := policy["thresholds"].(map[string]interface{})
+	return normalizeLimitKeys(thresholds)
+}
+
+func normalizeLimitKeys(limits map[string]interface{}) error {
+	for key, value := range limits {
+		normalizedKey, err := normalizeLimitKey(key)
+		if err != nil {
+			return err
+		}
+		if normalizedKey == key {
+			continue
+		}
+		delete(limits, key)
+		if existing, ok := limits[normalizedKey]; ok {
+			existingLimit, err := decimal.NewFromString(fmt.Sprint(existing))
+			if err != nil {
+				return err
+			}
+			limit, err := decimal.NewFromString(fmt.Sprint(value))
+			if err != nil {
+				return err
+			}
+			if existingLimit.LessThan(limit) {
+				continue
+			}
+		}
+		limits[normalizedKey] = value
+	}
+	return nil
+}
+
+// migrateAccountRecord upgrades a record to the current schema version. It reports whether anything was changed.
+func migrateAccountRecord(record map[string]interface{}) (bool, error) {
+	version := 0
+	if raw, ok := record["schema_version"]; ok {
+		number, ok := raw.(float64)
+		if !ok || number < 0 || number != float64(int(number)) {
+			return false, fmt.Errorf("invalid schema_version %v", raw)
+		}
+		version = int(number)
+	}
+	if version > accountSchemaVersion {
+		return false, fmt.Errorf("schema version %d is newer than the supported version %d", version, accountSchemaVersion)
+	}
+
+	migrated := false
+	for ; version < accountSchemaVersion; version++ {
+		err := accountMigrations[version](record)
+		if err != nil {
+			return false, fmt.Errorf("migrating from schema version %d: %s", version, err)
+		}
+		record["schema_version"] = version + 1
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// decodeAccountRecord migrates a raw stored record and decodes it. It reports whether the record was migrated.
+func decodeAccountRecord(raw json.RawMessage) (*Account, bool, error) {
+	var record map[string]interface{}
+	err := json.Unmarshal(raw, &record)
+	if err != nil {
+		return nil, false, err
+	}
+
+	migrated, err := migrateAccountRecord(record)
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	var account Account
+	err = json.Unmarshal(value, &account)
+	if err != nil {
+		return nil, false, err
+	}
+	return &account, migrated, nil
+}
+
+func migrationPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "migrate/accounts",
+			HelpSynopsis: "Upgrade every stored account to the current schema version.",
+			HelpDescription: "Accounts are also upgraded one at a time when they are read. " +
+				"Reading this path returns the current schema version.",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathReadAccountSchema,
+				logical.CreateOperation: b.pathMigrateAccounts,
+				logical.UpdateOperation: b.pathMigrateAccounts,
+			},
+		},
+	}
+}
+
+// Returns the current account schema version
+func (b *backend) pathReadAccountSchema(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"schema_version": accountSchemaVersion,
+		},
+	}, nil
+}
+
+// Migrates every stored account, reporting the accounts that could not be migrated
+func (b *backend) pathMigrateAccounts(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	names, err := req.Storage.List(ctx, "accounts/")
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := 0
+	failed := map[string]string{}
+	for _, name := range names {
+		var raw json.RawMessage
+		found, err := b.getEncrypted(ctx, req.Storage, "accounts/"+name, &raw)
+		if err != nil {
+			failed[name] = err.Error()
+			continue
+		}
+		if !found {
+			continue
+		}
+		account, changed, err := decodeAccountRecord(raw)
+		if err != nil {
+			failed[name] = err.Error()
+			continue
+		}
+		if !changed {
+			continue
+		}
+		err = b.writeVaultAccount(ctx, req, "accounts/"+name, account)
+		if err != nil {
+			return nil, err
+		}
+		migrated++
+	}
+
+	log.Printf("migrated %d of %d accounts to schema version %d", migrated, len(names), accountSchemaVersion)
+
+	response := &logical.Response{
+		Data: map[string]interface{}{
+			"schema_version": accountSchemaVersion,
+			"accounts":       len(names),
+			"migrated":       migrated,
+		},
+	}
+	if len(failed) > 0 {
+		response.Data["failed"] = failed
+		response.AddWarning(fmt.Sprintf("%d accounts could not be migrated", len(failed)))
+	}
+	return response, nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/vault/logical"
+	"github.com/rubblelabs/ripple/crypto"
+	"testing"
+)
+
+// storeRawAccount writes a record exactly as an older version of the backend would have
+func storeRawAccount(t *testing.T, storage logical.Storage, name string, record map[string]interface{}) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Put(context.Background(), &logical.StorageEntry{Key: "accounts/" + name, Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRawAccount(t *testing.T, storage logical.Storage, name string) map[string]interface{} {
+	entry, err := storage.Get(context.Background(), "accounts/"+name)
+	if err != nil || entry == nil {
+		t.Fatalf("account %s not found: %v", name, err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(entry.Value, &record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// testAccountRecord returns the original, unversioned shape of a generated account
+func testAccountRecord(t *testing.T, name string) map[string]interface{} {
+	seed, err := crypto.GenerateFamilySeed(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := accountFromSeed(keyTypeSecp256k1, seed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"account_id":     account.AccountId,
+		"public_key":     account.PublicKey,
+		"private_key":    account.PrivateKey,
+		"secret":         account.Secret,
+		"tx_spend_limit": "1000",
+		"whitelist":      nil,
+		"blacklist":      nil,
+	}
+}
+
+func TestAccountMigration_originalShape(t *testing.T) {
+	td := setupTest(t)
+	storeRawAccount(t, td.S, "original", testAccountRecord(t, "original"))
+
+	resp := readAccountPath(td, "original", t)
+	if resp.Data["keyType"] != keyTypeSecp256k1 {
+		t.Fatalf("expected the key type to default to secp256k1: %v", resp.Data)
+	}
+
+	// Reading upgrades the stored record
+	record := readRawAccount(t, td.S, "original")
+	if record["schema_version"] != float64(accountSchemaVersion) {
+		t.Fatalf("expected the record to be upgraded: %v", record)
+	}
+	if _, ok := record["private_key"]; ok {
+		t.Fatalf("expected the private key to be dropped: %v", record)
+	}
+	if record["key_type"] != keyTypeSecp256k1 {
+		t.Fatalf("expected the key type to be stored: %v", record)
+	}
+
+	// The upgraded account can still sign
+	createAccount(td, "migrationFunder", t)
+	submitSignedTransaction(td, createPayment(td, "migrationFunder", "original", "100", t)["signed_transaction"], t)
+	submitSignedTransaction(td, createPayment(td, "original", "migrationFunder", "10", t)["signed_transaction"], t)
+}
+
+func TestAccountMigration_emptySpendLimit(t *testing.T) {
+	td := setupTest(t)
+	record := testAccountRecord(t, "noLimit")
+	record["tx_spend_limit"] = ""
+	storeRawAccount(t, td.S, "noLimit", record)
+
+	resp := readAccountPath(td, "noLimit", t)
+	if *resp.Data["txSpendLimit"].(*string) != "0" {
+		t.Fatalf("expected an empty spend limit to become 0: %v", resp.Data)
+	}
+}
+
+func TestAccountMigration_importedPrivateKey(t *testing.T) {
+	td := setupTest(t)
+	record := testAccountRecord(t, "imported")
+	delete(record, "secret")
+	storeRawAccount(t, td.S, "imported", record)
+
+	readAccountPath(td, "imported", t)
+	migrated := readRawAccount(t, td.S, "imported")
+	if migrated["private_key"] != record["private_key"] {
+		t.Fatalf("expected the private key of an account without a seed to be kept: %v", migrated)
+	}
+}
+
+func TestAccountMigration_ed25519BeforeVersioning(t *testing.T) {
+	td := setupTest(t)
+	seed, err := crypto.GenerateFamilySeed("unversionedEd25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := accountFromSeed(keyTypeEd25519, seed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRawAccount(t, td.S, "unversionedEd25519", map[string]interface{}{
+		"account_id":     account.AccountId,
+		"public_key":     account.PublicKey,
+		"private_key":    account.PrivateKey,
+		"secret":         account.Secret,
+		"key_type":       keyTypeEd25519,
+		"tx_spend_limit": "0",
+	})
+
+	resp := readAccountPath(td, "unversionedEd25519", t)
+	if resp.Data["keyType"] != keyTypeEd25519 {
+		t.Fatalf("expected the key type to be kept: %v", resp.Data)
+	}
+}
+
+func TestAccountMigration_currencyLimitKeys(t *testing.T) {
+	td := setupTest(t)
+	record := testAccountRecord(t, "typedKeys")
+	issuer := record["account_id"].(string)
+	record["schema_version"] = 1
+	record["currency_spend_limits"] = map[string]interface{}{
+		"usd/" + issuer: "100",
+		"USD/" + issuer: "50",
+		"0000000000000000000000005553440000000000/" + issuer: "70",
+	}
+	record["approval_policy"] = map[string]interface{}{
+		"thresholds": map[string]interface{}{"0000000000000000000000005553440000000000/" + issuer: "10"},
+		"approvals":  2,
+	}
+	storeRawAccount(t, td.S, "typedKeys", record)
+
+	account, err := td.B.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/typedKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(account.CurrencySpendLimits) != 2 || account.CurrencySpendLimits["USD/"+issuer] != "50" {
+		t.Fatalf("expected the limits to be merged under the normalized key, keeping the lower one: %v", account.CurrencySpendLimits)
+	}
+	if account.CurrencySpendLimits["usd/"+issuer] != "100" {
+		t.Fatalf("expected currency codes differing in case to keep their own limits: %v", account.CurrencySpendLimits)
+	}
+	if account.ApprovalPolicy.Thresholds["USD/"+issuer] != "10" {
+		t.Fatalf("expected the threshold key to be normalized: %v", account.ApprovalPolicy.Thresholds)
+	}
+}
+
+func TestAccountMigration_newerVersion(t *testing.T) {
+	td := setupTest(t)
+	record := testAccountRecord(t, "fromTheFuture")
+	record["schema_version"] = accountSchemaVersion + 1
+	storeRawAccount(t, td.S, "fromTheFuture", record)
+
+	_, err := td.B.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/fromTheFuture")
+	if err == nil {
+		t.Fatalf("expected a record with a newer schema version to be refused")
+	}
+}
+
+func TestAccountMigration_bulk(t *testing.T) {
+	td := setupTest(t)
+	storeRawAccount(t, td.S, "bulk1", testAccountRecord(t, "bulk1"))
+	storeRawAccount(t, td.S, "bulk2", testAccountRecord(t, "bulk2"))
+	createAccount(td, "current", t)
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "migrate/accounts",
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to migrate accounts: %v %v", err, resp)
+	}
+	if resp.Data["accounts"] != 3 || resp.Data["migrated"] != 2 {
+		t.Fatalf("expected the two old accounts to be migrated: %v", resp.Data)
+	}
+	for _, name := range []string{"bulk1", "bulk2"} {
+		if record := readRawAccount(t, td.S, name); record["schema_version"] != float64(accountSchemaVersion) {
+			t.Fatalf("expected %s to be upgraded: %v", name, record)
+		}
+	}
+}
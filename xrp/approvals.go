@@ -0,0 +1,601 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/shopspring/decimal"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// pendingTxStoragePrefix holds the payments waiting for approval, keyed by id
+	pendingTxStoragePrefix = "pending_txs/"
+
+	defaultRequiredApprovals = 2
+	defaultApprovalTTL       = 24 * time.Hour
+
+	pendingStatusPending  = "pending"
+	pendingStatusSigned   = "signed"
+	pendingStatusRejected = "rejected"
+	pendingStatusExpired  = "expired"
+
+	// Kinds of pending transactions, which tell how the stored request is signed once approved
+	pendingKindPayment       = "payment"
+	pendingKindAccountDelete = "account_delete"
+)
+
+// ApprovalPolicy holds payments above a threshold, per currency, until Approvals Vault entities other than
+// the requester have approved them. Payments not approved within TTL expire. Account funding payments and
+// AccountDelete sweeps are held like any other payment.
+type ApprovalPolicy struct {
+	Thresholds map[string]string `json:"thresholds"`
+	Approvals  int               `json:"approvals"`
+	TTL        time.Duration     `json:"ttl"`
+}
+
+// PendingTransaction is a payment or sweep request held for approval. The request is kept as it was made and
+// is only turned into a transaction and signed once enough approvals are in, provided it still sends Amount to
+// Destination.
+type PendingTransaction struct {
+	ID                string                 `json:"id"`
+	Kind              string                 `json:"kind"`
+	Account           string                 `json:"account"`
+	Destination       string                 `json:"destination"`
+	Amount            string                 `json:"amount"`
+	Request           map[string]interface{} `json:"request"`
+	RequestedBy       string                 `json:"requested_by"`
+	CreatedAt         time.Time              `json:"created_at"`
+	ExpiresAt         time.Time              `json:"expires_at"`
+	RequiredApprovals int                    `json:"required_approvals"`
+	Approvals         map[string]time.Time   `json:"approvals"`
+	Status            string                 `json:"status"`
+	RejectedBy        string                 `json:"rejected_by,omitempty"`
+	Error             string                 `json:"error,omitempty"`
+	TransactionHash   string                 `json:"transaction_hash,omitempty"`
+	SignedTransaction string                 `json:"signed_transaction,omitempty"`
+}
+
+func approvalPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/approval_policy",
+			HelpSynopsis: "Require the approval of other operators for large payments from an account.",
+			HelpDescription: "Payments above the threshold for their currency are not signed. They are stored under " +
+				"pending/ until approvals Vault entities other than the requester approve them, and expire after ttl.",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"thresholds": &framework.FieldSchema{
+					Type:        framework.TypeMap,
+					Description: "Amounts above which payments need approval, keyed by XRP or <currency>/<issuer>",
+				},
+				"approvals": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Number of distinct entities that must approve a payment",
+					Default:     defaultRequiredApprovals,
+				},
+				"ttl": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) How long a payment waits for approval, e.g. 24h",
+					Default:     int(defaultApprovalTTL / time.Second),
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathWriteApprovalPolicy,
+				logical.UpdateOperation: b.pathWriteApprovalPolicy,
+				logical.ReadOperation:   b.pathReadApprovalPolicy,
+				logical.DeleteOperation: b.pathDeleteApprovalPolicy,
+			},
+		},
+		&framework.Path{
+			Pattern: "pending/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathListPendingTransactions,
+			},
+		},
+		&framework.Path{
+			Pattern:      "pending/" + framework.GenericNameRegex("id"),
+			HelpSynopsis: "Read a payment held for approval.",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathReadPendingTransaction,
+			},
+		},
+		&framework.Path{
+			Pattern:      "pending/" + framework.GenericNameRegex("id") + "/approve",
+			HelpSynopsis: "Approve a payment held for approval.",
+			HelpDescription: "Each Vault entity other than the requester can approve a payment once. The approval " +
+				"that completes the quorum signs the payment and returns it. If signing fails, for instance because " +
+				"a velocity limit is reached, any approver can approve again to retry.",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathApprovePendingTransaction,
+				logical.UpdateOperation: b.pathApprovePendingTransaction,
+			},
+		},
+		&framework.Path{
+			Pattern:      "pending/" + framework.GenericNameRegex("id") + "/reject",
+			HelpSynopsis: "Reject a payment held for approval. The requester can reject it to cancel it.",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathRejectPendingTransaction,
+				logical.UpdateOperation: b.pathRejectPendingTransaction,
+			},
+		},
+	}
+}
+
+// Sets the approval policy of an account
+func (b *backend) pathWriteApprovalPolicy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	thresholdsRaw, ok := d.GetOk("thresholds")
+	if !ok {
+		return errMissingField("thresholds"), nil
+	}
+	thresholds, err := parseCurrencySpendLimits(thresholdsRaw.(map[string]interface{}))
+	if err != nil {
+		return logical.ErrorResponse("invalid thresholds: " + err.Error()), nil
+	}
+	if len(thresholds) == 0 {
+		return errMissingField("thresholds"), nil
+	}
+	approvals := d.Get("approvals").(int)
+	if approvals < 1 {
+		return logical.ErrorResponse("approvals must be at least 1"), nil
+	}
+	ttl := time.Duration(d.Get("ttl").(int)) * time.Second
+	if ttl <= 0 {
+		return logical.ErrorResponse("ttl must be positive"), nil
+	}
+
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + d.Get("name").(string)
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+
+	vaultAccount.ApprovalPolicy = &ApprovalPolicy{
+		Thresholds: thresholds,
+		Approvals:  approvals,
+		TTL:        ttl,
+	}
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.pathReadApprovalPolicy(ctx, req, d)
+}
+
+// Returns the approval policy of an account
+func (b *backend) pathReadApprovalPolicy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	vaultAccount, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil || vaultAccount.ApprovalPolicy == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"thresholds": vaultAccount.ApprovalPolicy.Thresholds,
+			"approvals":  vaultAccount.ApprovalPolicy.Approvals,
+			"ttl":        int64(vaultAccount.ApprovalPolicy.TTL / time.Second),
+		},
+	}, nil
+}
+
+// Stops holding payments of an account for approval. Payments already held still need their approvals.
+func (b *backend) pathDeleteApprovalPolicy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + d.Get("name").(string)
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil || vaultAccount.ApprovalPolicy == nil {
+		return nil, nil
+	}
+	vaultAccount.ApprovalPolicy = nil
+	return nil, b.writeVaultAccount(ctx, req, path, vaultAccount)
+}
+
+// Lists the ids of the payments held for approval
+func (b *backend) pathListPendingTransactions(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, pendingTxStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(ids), nil
+}
+
+// Returns a payment held for approval and its approvals
+func (b *backend) pathReadPendingTransaction(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	pending, err := b.readPendingTransaction(ctx, req.Storage, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: pending.responseData(time.Now()),
+	}, nil
+}
+
+// Approves a payment held for approval, and signs it once the quorum is reached
+func (b *backend) pathApprovePendingTransaction(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if req.EntityID == "" {
+		return nil, logical.CodedError(403, "approving a transaction requires a Vault entity")
+	}
+
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	pending, err := b.readOpenPendingTransaction(ctx, req.Storage, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if pending.RequestedBy == req.EntityID {
+		return nil, logical.CodedError(403, "a transaction cannot be approved by the entity that requested it")
+	}
+
+	now := time.Now()
+	if _, ok := pending.Approvals[req.EntityID]; !ok {
+		pending.Approvals[req.EntityID] = now.UTC()
+		log.Printf("pending transaction %s approved by %s (%d of %d)", pending.ID, req.EntityID, len(pending.Approvals), pending.RequiredApprovals)
+	} else if len(pending.Approvals) < pending.RequiredApprovals {
+		return logical.ErrorResponse(fmt.Sprintf("transaction %s is already approved by %s", pending.ID, req.EntityID)), nil
+	}
+
+	if len(pending.Approvals) < pending.RequiredApprovals {
+		err = b.writePendingTransaction(ctx, req.Storage, pending)
+		if err != nil {
+			return nil, err
+		}
+		return &logical.Response{
+			Data: pending.responseData(now),
+		}, nil
+	}
+
+	// The quorum is reached: sign the payment as it was requested, checking it against the account policy again
+	response, signErr := b.signPendingTransaction(ctx, req, pending)
+	if signErr != nil || response.IsError() {
+		if signErr != nil {
+			pending.Error = signErr.Error()
+		} else {
+			pending.Error = response.Error().Error()
+		}
+		err = b.writePendingTransaction(ctx, req.Storage, pending)
+		if err != nil {
+			return nil, err
+		}
+		return response, signErr
+	}
+
+	pending.Status = pendingStatusSigned
+	pending.Error = ""
+	pending.TransactionHash = response.Data["transaction_hash"].(string)
+	pending.SignedTransaction = response.Data["signed_transaction"].(string)
+	err = b.writePendingTransaction(ctx, req.Storage, pending)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("pending transaction %s signed as %s", pending.ID, pending.TransactionHash)
+
+	response.Data["pending_id"] = pending.ID
+	response.Data["approved_by"] = pending.approvers()
+	return response, nil
+}
+
+// Rejects a payment held for approval, which can then no longer be signed
+func (b *backend) pathRejectPendingTransaction(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if req.EntityID == "" {
+		return nil, logical.CodedError(403, "rejecting a transaction requires a Vault entity")
+	}
+
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	pending, err := b.readOpenPendingTransaction(ctx, req.Storage, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	pending.Status = pendingStatusRejected
+	pending.RejectedBy = req.EntityID
+	err = b.writePendingTransaction(ctx, req.Storage, pending)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("pending transaction %s rejected by %s", pending.ID, req.EntityID)
+
+	return &logical.Response{
+		Data: pending.responseData(time.Now()),
+	}, nil
+}
+
+// requiresApproval reports whether a payment of amount must be held for approval. A nil policy never holds payments,
+// and a nil amount, which cannot be known, is always held.
+func (p *ApprovalPolicy) requiresApproval(amount *spendAmount) bool {
+	if p == nil {
+		return false
+	}
+	if amount == nil {
+		return true
+	}
+	threshold, ok := p.Thresholds[amount.limitKey()]
+	if !ok {
+		return false
+	}
+	limit, err := decimal.NewFromString(threshold)
+	if err != nil {
+		// Thresholds are validated when the policy is written, hold the payment rather than let it through
+		return true
+	}
+	return amount.Value.GreaterThan(limit)
+}
+
+// newPendingTransaction prepares the request of req.EntityID to send amount from the source account to
+// destination for approval under policy. It is only held once written with holdForApproval.
+func newPendingTransaction(req *logical.Request, kind string, request map[string]interface{}, source string, destination string, amount *spendAmount, policy *ApprovalPolicy) (*PendingTransaction, error) {
+	id, err := newPendingTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &PendingTransaction{
+		ID:                id,
+		Kind:              kind,
+		Account:           source,
+		Destination:       destination,
+		Amount:            pendingAmount(amount),
+		Request:           request,
+		RequestedBy:       req.EntityID,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(policy.TTL),
+		RequiredApprovals: policy.Approvals,
+		Approvals:         make(map[string]time.Time),
+		Status:            pendingStatusPending,
+	}, nil
+}
+
+// holdForApproval stores a pending transaction instead of signing it, and returns the id it is approved under
+func (b *backend) holdForApproval(ctx context.Context, s logical.Storage, pending *PendingTransaction) (*logical.Response, error) {
+	err := b.writePendingTransaction(ctx, s, pending)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s of %s from %s to %s held for approval as %s", pending.Kind, pending.Amount, pending.Account, pending.Destination, pending.ID)
+
+	return &logical.Response{
+		Data: pending.responseData(time.Now()),
+	}, nil
+}
+
+// signPendingTransaction replays the stored request, on behalf of the entity that made it
+func (b *backend) signPendingTransaction(ctx context.Context, req *logical.Request, pending *PendingTransaction) (*logical.Response, error) {
+	switch pending.Kind {
+	case pendingKindPayment:
+		paymentReq := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "payments",
+			Data:      pending.Request,
+			Storage:   req.Storage,
+			EntityID:  pending.RequestedBy,
+		}
+		d := &framework.FieldData{
+			Raw:    pending.Request,
+			Schema: paymentFields(),
+		}
+		return b.signPaymentRequest(ctx, paymentReq, d, pending)
+	case pendingKindAccountDelete:
+		deleteReq := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "accounts/" + pending.Account + "/delete",
+			Data:      pending.Request,
+			Storage:   req.Storage,
+			EntityID:  pending.RequestedBy,
+		}
+		d := &framework.FieldData{
+			Raw:    pending.Request,
+			Schema: accountDeleteFields(),
+		}
+		return b.signAccountDeleteRequest(ctx, deleteReq, d, pending)
+	default:
+		return nil, fmt.Errorf("unknown kind %q of pending transaction %s", pending.Kind, pending.ID)
+	}
+}
+
+// checkApproved refuses to sign an approved transaction unless it sends what was approved to the approved
+// destination, which may have changed since, for instance if the destination is a Vault account whose keys
+// were replaced
+func (p *PendingTransaction) checkApproved(destination string, amount *spendAmount) error {
+	if destination != p.Destination || pendingAmount(amount) != p.Amount {
+		return logical.CodedError(409, fmt.Sprintf("transaction %s would send %s to %s, but %s to %s was approved",
+			p.ID, pendingAmount(amount), destination, p.Amount, p.Destination))
+	}
+	return nil
+}
+
+// pendingAmount returns the amount shown for a pending transaction, which is empty for an offline sweep of
+// an unknown balance
+func pendingAmount(amount *spendAmount) string {
+	if amount == nil {
+		return ""
+	}
+	return amount.String()
+}
+
+// expirePendingTransactions is run periodically and marks the transactions still waiting for approval past
+// their expiry as expired. Signed, rejected and expired transactions are kept as the record of the approvals.
+func (b *backend) expirePendingTransactions(ctx context.Context, s logical.Storage) error {
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	ids, err := s.List(ctx, pendingTxStoragePrefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids {
+		pending, err := b.readPendingTransaction(ctx, s, id)
+		if err != nil {
+			// Keep going so one broken entry does not hold up the others
+			log.Printf("failed to read pending transaction %s: %s", id, err)
+			continue
+		}
+		if pending == nil || pending.Status != pendingStatusPending || !pending.expired(now) {
+			continue
+		}
+		pending.Status = pendingStatusExpired
+		err = b.writePendingTransaction(ctx, s, pending)
+		if err != nil {
+			return err
+		}
+		log.Printf("pending transaction %s expired with %d of %d approvals", id, len(pending.Approvals), pending.RequiredApprovals)
+	}
+	return nil
+}
+
+// readOpenPendingTransaction returns a pending transaction that can still be approved or rejected
+func (b *backend) readOpenPendingTransaction(ctx context.Context, s logical.Storage, id string) (*PendingTransaction, error) {
+	pending, err := b.readPendingTransaction(ctx, s, id)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, logical.CodedError(404, "pending transaction not found")
+	}
+	status := pending.status(time.Now())
+	if status != pendingStatusPending {
+		return nil, logical.CodedError(400, fmt.Sprintf("transaction %s is %s", id, status))
+	}
+	return pending, nil
+}
+
+func (p *PendingTransaction) expired(now time.Time) bool {
+	return !now.Before(p.ExpiresAt)
+}
+
+// status returns the stored status, or expired for a transaction that was still waiting for approval
+func (p *PendingTransaction) status(now time.Time) string {
+	if p.Status == pendingStatusPending && p.expired(now) {
+		return pendingStatusExpired
+	}
+	return p.Status
+}
+
+// approvers returns the entities that approved the transaction, in the order they approved it
+func (p *PendingTransaction) approvers() []string {
+	approvers := make([]string, 0, len(p.Approvals))
+	for entity := range p.Approvals {
+		approvers = append(approvers, entity)
+	}
+	sort.Slice(approvers, func(i, j int) bool {
+		return p.Approvals[approvers[i]].Before(p.Approvals[approvers[j]])
+	})
+	return approvers
+}
+
+func (p *PendingTransaction) responseData(now time.Time) map[string]interface{} {
+	responseData := map[string]interface{}{
+		"pending_id":          p.ID,
+		"kind":                p.Kind,
+		"status":              p.status(now),
+		"account":             p.Account,
+		"destination_address": p.Destination,
+		"amount":              p.Amount,
+		"requested_by":        p.RequestedBy,
+		"created_at":          p.CreatedAt,
+		"expires_at":          p.ExpiresAt,
+		"approvals_required":  p.RequiredApprovals,
+		"approved_by":         p.approvers(),
+	}
+	if p.RejectedBy != "" {
+		responseData["rejected_by"] = p.RejectedBy
+	}
+	if p.Error != "" {
+		responseData["error"] = p.Error
+	}
+	if p.TransactionHash != "" {
+		responseData["transaction_hash"] = p.TransactionHash
+		responseData["signed_transaction"] = p.SignedTransaction
+	}
+	return responseData
+}
+
+func newPendingTransactionID() (string, error) {
+	id := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (b *backend) readPendingTransaction(ctx context.Context, s logical.Storage, id string) (*PendingTransaction, error) {
+	entry, err := s.Get(ctx, pendingTxStoragePrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	var pending PendingTransaction
+	err = entry.DecodeJSON(&pending)
+	if err != nil {
+		return nil, err
+	}
+	if pending.Approvals == nil {
+		pending.Approvals = make(map[string]time.Time)
+	}
+	if pending.Kind == "" {
+		// Pending transactions written before sweeps could be held are all payments
+		pending.Kind = pendingKindPayment
+	}
+	return &pending, nil
+}
+
+func (b *backend) writePendingTransaction(ctx context.Context, s logical.Storage, pending *PendingTransaction) error {
+	entry, err := logical.StorageEntryJSON(pendingTxStoragePrefix+pending.ID, pending)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
@@ -18,6 +18,8 @@ package xrp
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -26,6 +28,45 @@ import (
 
 type backend struct {
 	*framework.Backend
+
+	// newLedgerClient connects to the ledger described by the mount configuration
+	newLedgerClient ledgerClientFactory
+
+	// client is the connection shared by all requests, dialed on first use
+	client          ledgerClient
+	clientEndpoint  string
+	clientEndpoints string
+	clientLock      sync.Mutex
+
+	// health tracks the result of the most recent check of each endpoint
+	health          map[string]*endpointHealth
+	lastHealthCheck time.Time
+	healthLock      sync.RWMutex
+
+	// walletLock serializes changes to wallets and the indexes derived from them
+	walletLock sync.Mutex
+
+	// mountKeyLock serializes rotations of the mount key. storageLock is held for reading by every encrypted
+	// write and for writing while entries are rewrapped, so no entry is written with a key version being retired.
+	mountKeyLock sync.Mutex
+	storageLock  sync.RWMutex
+
+	// rotationLock serializes changes to the regular keys of accounts, keyUsageLock the signature counts
+	rotationLock sync.Mutex
+	keyUsageLock sync.Mutex
+
+	// spendLock serializes velocity limit checks with the recording of the payments that passed them
+	spendLock sync.Mutex
+
+	// approvalLock serializes approvals, so a pending transaction reaching its quorum is signed once
+	approvalLock sync.Mutex
+
+	// accountLock is held from reading an account to writing it back, so no change to an account overwrites
+	// another. It is taken after any of the locks above, and only keyUsageLock is taken while it is held.
+	accountLock sync.Mutex
+
+	// generateFaucetAccount asks the faucet at the given url for a funded account used to fund new accounts
+	generateFaucetAccount func(faucetURL string) (string, string, error)
 }
 
 // Factory creates a new usable instance of this secrets engine.
@@ -39,14 +80,37 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 
 func Backend() *backend {
 	var b backend
+	b.newLedgerClient = newTransportLedgerClient
+	b.generateFaucetAccount = generateFaucetAccount
 	b.Backend = &framework.Backend{
 		Help: "",
 		Paths: framework.PathAppend(
+			configPaths(&b),
+			mountKeyPaths(&b),
+			healthPaths(&b),
 			accountsPaths(&b),
+			accountImportPaths(&b),
+			accountDeletePaths(&b),
+			regularKeyPaths(&b),
+			rotationPaths(&b),
+			velocityLimitPaths(&b),
+			approvalPaths(&b),
+			denylistPaths(&b),
+			migrationPaths(&b),
+			walletsPaths(&b),
 			paymentsPaths(&b)),
-		PathsSpecial: &logical.Paths{},
+		PathsSpecial: &logical.Paths{
+			SealWrapStorage: []string{
+				"accounts/",
+				walletStoragePrefix,
+				mountKeyStoragePath,
+			},
+		},
 		Secrets:      []*framework.Secret{},
 		BackendType:  logical.TypeLogical,
+		Invalidate:   b.invalidate,
+		Clean:        b.cleanup,
+		PeriodicFunc: b.periodicFunc,
 	}
 	return &b
 }
@@ -20,8 +20,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"github.com/rubblelabs/ripple/crypto"
 	"github.com/rubblelabs/ripple/data"
-	"github.com/rubblelabs/ripple/websockets"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,19 +41,15 @@ const (
 type testData struct {
 	B      logical.Backend
 	S      logical.Storage
-	Remote websockets.Remote
+	Ledger *fakeLedger
 }
 
 func setupTest(t *testing.T) *testData {
 	b, reqStorage := getTestBackend(t)
-	rippleRemote, err := websockets.NewRemote("wss://s.altnet.rippletest.net:51233")
-	if err != nil {
-		t.Fatalf("Unable to connect to Ripple testnet: %v", err)
-	}
 	return &testData{
 		B:      b,
 		S:      reqStorage,
-		Remote: *rippleRemote,
+		Ledger: useFakeLedger(b),
 	}
 }
 
@@ -68,6 +67,7 @@ func getTestBackend(t *testing.T) (logical.Backend, logical.Storage) {
 	if err != nil {
 		t.Fatalf("unable to create backend: %v", err)
 	}
+	useFakeLedger(b)
 
 	return b, config.StorageView
 }
@@ -140,24 +140,7 @@ func TestBackend_submitPayment(t *testing.T) {
 		t.Fatalf("expected signedTx data not present in createPayment")
 	}
 
-	decodedString, err := hex.DecodeString(signedTx.(string))
-	if err != nil {
-		t.Fatalf("unable to decode signedTx: %v", err)
-	}
-
-	byteReader := bytes.NewReader(decodedString)
-	transaction, err := data.ReadTransaction(byteReader)
-	if err != nil {
-		Log(err)
-		t.Fatalf("unable to read signed_transaction as a valid Ripple transaction: %v", err)
-	}
-
-	response, err := td.Remote.Submit(transaction)
-	if err != nil {
-		t.Fatalf("failed to submit transaction to testnet: %v", err)
-	}
-
-	t.Logf("Submitted transaction result : %s -- %s", response.EngineResult.String(), response.EngineResultMessage)
+	submitSignedTransaction(td, signedTx, t)
 }
 
 func TestBackend_submitPaymentAboveLimit(t *testing.T) {
@@ -166,31 +149,33 @@ func TestBackend_submitPaymentAboveLimit(t *testing.T) {
 	createAccount(td, "testSourceAccount", t)
 	createAccount(td, "testDestinationAccount", t)
 
-	respData := createPayment(td, "testSourceAccount", "testDestinationAccount", "1001", t)
-
-	signedTx, ok := respData["signed_transaction"]
-	if !ok {
-		t.Fatalf("expected signedTx data not present in createPayment")
-	}
+	// The limit is 1000 XRP, and fractions of an XRP count
+	resp, err := requestPayment(td, map[string]interface{}{
+		"source":      "testSourceAccount",
+		"destination": "testDestinationAccount",
+		"assetCode":   "native",
+		"amount":      "1000.000001",
+	})
+	expectPolicyDenied(t, resp, err)
 
-	decodedString, err := hex.DecodeString(signedTx.(string))
-	if err != nil {
-		t.Fatalf("unable to decode signedTx: %v", err)
-	}
+	createPayment(td, "testSourceAccount", "testDestinationAccount", "1000", t)
+}
 
-	byteReader := bytes.NewReader(decodedString)
-	transaction, err := data.ReadTransaction(byteReader)
-	if err != nil {
-		Log(err)
-		t.Fatalf("unable to read signed_transaction as a valid Ripple transaction: %v", err)
-	}
+// requestPayment sends a payments request, returning the error instead of failing the test
+func requestPayment(td *testData, d map[string]interface{}) (*logical.Response, error) {
+	return td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "payments",
+		Data:      d,
+		Storage:   td.S,
+	})
+}
 
-	response, err := td.Remote.Submit(transaction)
-	if err != nil {
-		t.Fatalf("failed to submit transaction to testnet: %v", err)
+func expectPolicyDenied(t *testing.T, resp *logical.Response, err error) {
+	codedErr, ok := err.(logical.HTTPCodedError)
+	if !ok || codedErr.Code() != 403 {
+		t.Fatalf("expected signing to be denied with a 403: %v %v", err, resp)
 	}
-
-	t.Logf("Submitted transaction result : %s -- %s", response.EngineResult.String(), response.EngineResultMessage)
 }
 
 func createAccount(td *testData, accountName string, t *testing.T) {
@@ -279,6 +264,10 @@ func createPayment(td *testData, sourceAccountName string, destinationAccountNam
 			"assetCode":   "native",
 			"amount":      amount,
 		}
+	return createPaymentWithData(td, d, t)
+}
+
+func createPaymentWithData(td *testData, d map[string]interface{}, t *testing.T) map[string]interface{} {
 	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.CreateOperation,
 		Path:      fmt.Sprintf("payments"),
@@ -299,21 +288,2163 @@ func createPayment(td *testData, sourceAccountName string, destinationAccountNam
 	return resp.Data
 }
 
-func submitSignedTransaction(td *testData, signedTx interface{}, t *testing.T) *websockets.SubmitResult {
+func submitSignedTransaction(td *testData, signedTx interface{}, t *testing.T) *ledgerSubmitResult {
+	transaction := readSignedTransaction(t, signedTx)
+	response, err := td.Ledger.Submit(transaction)
+	if err != nil {
+		t.Fatalf("failed to submit transaction: %v", err)
+	}
+	if response.EngineResult != "tesSUCCESS" {
+		t.Fatalf("transaction was not applied: %s -- %s", response.EngineResult, response.EngineResultMessage)
+	}
+	t.Logf("Submitted transaction result : %s -- %s", response.EngineResult, response.EngineResultMessage)
+	return response
+}
+
+func TestBackend_config(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to read default config: %v %v", err, resp)
+	}
+	if resp.Data["network"] != defaultNetwork {
+		t.Fatalf("expected default network %s, got %v", defaultNetwork, resp.Data["network"])
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"endpoints":       "wss://xrplcluster.com,wss://s2.ripple.com",
+			"network":         "mainnet",
+			"request_timeout": 5,
+		},
+		Storage: storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to write config: %v %v", err, resp)
+	}
+
+	config, err := b.(*backend).readConfig(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Endpoints) != 2 || config.Endpoints[0] != "wss://xrplcluster.com" {
+		t.Fatalf("unexpected endpoints: %v", config.Endpoints)
+	}
+	if config.Network != "mainnet" || config.RequestTimeout != 5*time.Second || config.ConnectTimeout != defaultConnectTimeout {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"endpoints": "https://xrplcluster.com"},
+		Storage:   storage,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected an error for a non-websocket endpoint")
+	}
+
+	// Public networks are matched whatever their case, and any other name is kept as a private network
+	networkTests := []struct {
+		data    map[string]interface{}
+		network string
+	}{
+		{map[string]interface{}{"network": " "}, ""},
+		{map[string]interface{}{"network": "TestNet", "network_id": 1}, "testnet"},
+		{map[string]interface{}{"network": "corp-ledger", "network_id": 21}, "corp-ledger"},
+		{map[string]interface{}{"endpoints": "wss://rippled.corp.example"}, "corp-ledger"},
+	}
+	for _, test := range networkTests {
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data:      test.data,
+			Storage:   storage,
+		})
+		if err != nil || resp.IsError() != (test.network == "") {
+			t.Fatalf("unexpected result for %v: %v %v", test.data, err, resp)
+		}
+		if test.network != "" && resp.Data["network"] != test.network {
+			t.Fatalf("expected network %s for %v: %v", test.network, test.data, resp.Data)
+		}
+	}
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "config",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = b.(*backend).readConfig(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Endpoints[0] != defaultEndpoint {
+		t.Fatalf("expected config to revert to defaults, got %v", config.Endpoints)
+	}
+}
+
+func TestBackend_signPaymentOffline(t *testing.T) {
+	b, storage := getTestBackend(t)
+	storeTestAccount(t, storage, "offlineSource")
+	destination := storeTestAccount(t, storage, "offlineDestination")
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "payments",
+		Data: map[string]interface{}{
+			"source":               "offlineSource",
+			"destination":          "offlineDestination",
+			"assetCode":            "native",
+			"amount":               "25",
+			"offline":              true,
+			"sequence":             7,
+			"fee":                  "12",
+			"last_ledger_sequence": 1000,
+		},
+		Storage: storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to sign offline payment: %v %v", err, resp)
+	}
+
+	expectedFee, _ := data.NewNativeValue(12)
+	payment := readSignedTransaction(t, resp.Data["signed_transaction"]).(*data.Payment)
+	if payment.Sequence != 7 || payment.Fee.String() != expectedFee.String() || *payment.LastLedgerSequence != 1000 {
+		t.Fatalf("signed payment does not use the supplied values: %+v", payment)
+	}
+	if payment.Destination.String() != destination.AccountId {
+		t.Fatalf("unexpected destination %s", payment.Destination.String())
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "payments",
+		Data: map[string]interface{}{
+			"source":      "offlineSource",
+			"destination": "offlineDestination",
+			"assetCode":   "native",
+			"amount":      "25",
+			"offline":     true,
+		},
+		Storage: storage,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected offline signing without a sequence to fail")
+	}
+}
+
+// storeTestAccount writes a freshly generated account directly into storage, bypassing funding
+func storeTestAccount(t *testing.T, storage logical.Storage, name string) *Account {
+	seed, err := crypto.GenerateFamilySeed(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.NewECDSAKey(seed.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySequenceZero := uint32(0)
+	accountId, err := crypto.AccountId(key, &keySequenceZero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := crypto.AccountPublicKey(key, &keySequenceZero)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := &Account{
+		AccountId:    accountId.String(),
+		PublicKey:    publicKey.String(),
+		Secret:       seed.String(),
+		TxSpendLimit: "0",
+	}
+	entry, err := logical.StorageEntryJSON("accounts/"+name, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func readSignedTransaction(t *testing.T, signedTx interface{}) data.Transaction {
 	decodedString, err := hex.DecodeString(signedTx.(string))
 	if err != nil {
 		t.Fatalf("unable to decode signedTx: %v", err)
 	}
-	byteReader := bytes.NewReader(decodedString)
-	transaction, err := data.ReadTransaction(byteReader)
+	transaction, err := data.ReadTransaction(bytes.NewReader(decodedString))
 	if err != nil {
-		Log(err)
 		t.Fatalf("unable to read signed_transaction as a valid Ripple transaction: %v", err)
 	}
-	response, err := td.Remote.Submit(transaction)
+	return transaction
+}
+
+func TestBackend_sharedLedgerConnection(t *testing.T) {
+	td := setupTest(t)
+
+	dials := 0
+	td.B.(*backend).newLedgerClient = func(config *Config, endpoint string) (ledgerClient, error) {
+		dials++
+		return td.Ledger, nil
+	}
+
+	createAccount(td, "sharedSource", t)
+	createAccount(td, "sharedDestination", t)
+	createPayment(td, "sharedSource", "sharedDestination", "10", t)
+	if dials != 1 {
+		t.Fatalf("expected a single connection to be shared, got %d dials", dials)
+	}
+
+	_, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"network": "devnet"},
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPayment(td, "sharedSource", "sharedDestination", "10", t)
+	if dials != 2 {
+		t.Fatalf("expected a config change to redial, got %d dials", dials)
+	}
+
+	td.B.Cleanup(context.Background())
+	if td.B.(*backend).client != nil {
+		t.Fatalf("expected the connection to be closed on cleanup")
+	}
+}
+
+func TestBackend_endpointFailover(t *testing.T) {
+	td := setupTest(t)
+
+	down := map[string]bool{"wss://primary": true}
+	dialed := map[string]int{}
+	td.B.(*backend).newLedgerClient = func(config *Config, endpoint string) (ledgerClient, error) {
+		dialed[endpoint]++
+		if down[endpoint] {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return td.Ledger, nil
+	}
+
+	_, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"endpoints": "wss://primary,wss://secondary"},
+		Storage:   td.S,
+	})
 	if err != nil {
-		t.Fatalf("failed to submit transaction to testnet: %v", err)
+		t.Fatal(err)
+	}
+
+	createAccount(td, "failoverSource", t)
+	createAccount(td, "failoverDestination", t)
+	createPayment(td, "failoverSource", "failoverDestination", "10", t)
+	if dialed["wss://secondary"] != 1 {
+		t.Fatalf("expected to fail over to the secondary endpoint, dials: %v", dialed)
+	}
+
+	// The primary recovers, so the next health check moves the connection back to it
+	down["wss://primary"] = false
+	err = td.B.(*backend).periodicFunc(context.Background(), &logical.Request{Storage: td.S})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPayment(td, "failoverSource", "failoverDestination", "10", t)
+	if td.B.(*backend).clientEndpoint != "wss://primary" {
+		t.Fatalf("expected the primary endpoint to be used after recovery, got %s", td.B.(*backend).clientEndpoint)
+	}
+
+	// A stale validated ledger marks the endpoints unhealthy
+	td.Ledger.validatedLedgerAge = 5 * time.Minute
+	config, err := td.B.(*backend).readConfig(context.Background(), td.S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	td.B.(*backend).checkEndpoints(config)
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "health",
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range resp.Data["endpoints"].([]map[string]interface{}) {
+		if status["healthy"] != false {
+			t.Fatalf("expected %v to be unhealthy", status["endpoint"])
+		}
+	}
+}
+
+// droppedLedger is a connection whose node went away after it was dialed
+type droppedLedger struct {
+	*fakeLedger
+}
+
+func (l *droppedLedger) AccountInfo(account data.Account) (*ledgerAccountInfo, error) {
+	return nil, io.EOF
+}
+
+func TestBackend_failoverOnDroppedConnection(t *testing.T) {
+	td := setupTest(t)
+
+	dialed := map[string]int{}
+	td.B.(*backend).newLedgerClient = func(config *Config, endpoint string) (ledgerClient, error) {
+		dialed[endpoint]++
+		if endpoint == "wss://primary" {
+			return &droppedLedger{td.Ledger}, nil
+		}
+		return td.Ledger, nil
+	}
+	writeConfig(td, map[string]interface{}{"endpoints": "wss://primary,wss://secondary"}, t)
+
+	createAccount(td, "droppedSource", t)
+	createAccount(td, "droppedDestination", t)
+	createPayment(td, "droppedSource", "droppedDestination", "10", t)
+	if dialed["wss://secondary"] != 1 || td.B.(*backend).clientEndpoint != "wss://secondary" {
+		t.Fatalf("expected to fail over to the secondary endpoint, dials: %v", dialed)
+	}
+
+	// Errors returned by rippled itself do not fail over
+	if isConnectionError(fmt.Errorf("actNotFound: account not found")) {
+		t.Fatalf("expected a rippled error not to be a connection error")
+	}
+}
+
+func TestBackend_createAccountFunding(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "treasury", t)
+
+	writeConfig(td, map[string]interface{}{
+		"funding_mode":    "account",
+		"funding_account": "treasury",
+		"funding_amount":  "50",
+	}, t)
+	createAccount(td, "fundedByTreasury", t)
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "fundedByTreasury", t)); err != nil {
+		t.Fatalf("expected the account to be funded by the treasury: %v", err)
+	}
+
+	writeConfig(td, map[string]interface{}{"funding_mode": "none"}, t)
+	createAccount(td, "unfunded", t)
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "unfunded", t)); err == nil {
+		t.Fatalf("expected the account not to be funded")
+	}
+
+	writeConfig(td, map[string]interface{}{"funding_mode": "account", "funding_account": "missing"}, t)
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/orphan",
+		Storage:   td.S,
+	})
+	if err == nil && !resp.IsError() {
+		t.Fatalf("expected account creation to fail without a funding account")
+	}
+}
+
+func TestBackend_createAccountFundingFromEd25519Faucet(t *testing.T) {
+	td := setupTest(t)
+
+	// The testnet faucet hands out sEd... seeds, which must be signed with their Ed25519 key
+	td.Ledger.faucetKeyType = keyTypeEd25519
+	writeConfig(td, map[string]interface{}{"funding_mode": "faucet"}, t)
+	resp := createAccountWithData(td, "fundedByFaucet", map[string]interface{}{"xrp_balance": "20"}, t)
+	if resp.Data["funding_submitted"] != true {
+		t.Fatalf("expected the faucet funding payment to be applied: %v", resp.Data)
+	}
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "fundedByFaucet", t)); err != nil {
+		t.Fatalf("expected the account to be funded by the faucet account: %v", err)
+	}
+}
+
+func writeConfig(td *testData, d map[string]interface{}, t *testing.T) {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      d,
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+}
+
+// ledgerAccount returns the ledger account of the named Vault account
+func ledgerAccount(td *testData, accountName string, t *testing.T) data.Account {
+	account, err := td.B.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/"+accountName)
+	if err != nil || account == nil {
+		t.Fatalf("account %s not found: %v", accountName, err)
+	}
+	rippleAccount, err := data.NewAccountFromAddress(account.AccountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *rippleAccount
+}
+
+func TestBackend_createAccountFromSourceAccount(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "treasury", t)
+
+	resp := createAccountWithData(td, "fromTreasury", map[string]interface{}{
+		"source_account_name": "treasury",
+		"xrp_balance":         "20",
+	}, t)
+	if resp.Data["funding_submitted"] != true {
+		t.Fatalf("expected the funding payment to be submitted: %v", resp.Data)
+	}
+	if resp.Data["funding_source_address"] != ledgerAccount(td, "treasury", t).String() {
+		t.Fatalf("expected the treasury to fund the account: %v", resp.Data)
+	}
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "fromTreasury", t)); err != nil {
+		t.Fatalf("expected the account to be funded: %v", err)
+	}
+
+	// Fractions of an XRP are funded as requested and count towards the source's spend limit
+	resp = createAccountWithData(td, "fractionalBalance", map[string]interface{}{
+		"source_account_name": "treasury",
+		"xrp_balance":         "20.5",
+	}, t)
+	funding, ok := readSignedTransaction(t, resp.Data["funding_signed_transaction"]).(*data.Payment)
+	if !ok || funding.Amount.String() != "20.5/XRP" {
+		t.Fatalf("expected a funding payment of 20.5 XRP: %v", resp.Data)
+	}
+	_, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/aboveLimit",
+		Data: map[string]interface{}{
+			"source_account_name": "treasury",
+			"xrp_balance":         "1000.5",
+		},
+		Storage: td.S,
+	})
+	if codedErr, ok := err.(logical.HTTPCodedError); !ok || codedErr.Code() != 403 {
+		t.Fatalf("expected funding above the source's spend limit to be denied: %v", err)
+	}
+
+	resp = createAccountWithData(td, "signedOnly", map[string]interface{}{
+		"source_account_name": "treasury",
+		"xrp_balance":         "20",
+		"submit":              false,
+	}, t)
+	if resp.Data["funding_submitted"] != false || resp.Data["funding_signed_transaction"] == "" {
+		t.Fatalf("expected a signed but unsubmitted funding payment: %v", resp.Data)
+	}
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "signedOnly", t)); err == nil {
+		t.Fatalf("expected the account not to be funded")
+	}
+
+	_, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/belowReserve",
+		Data: map[string]interface{}{
+			"source_account_name": "treasury",
+			"xrp_balance":         "0.5",
+		},
+		Storage: td.S,
+	})
+	if err == nil {
+		t.Fatalf("expected funding below the base reserve to fail")
+	}
+}
+
+func createAccountWithData(td *testData, accountName string, d map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      fmt.Sprintf("accounts/%s", accountName),
+		Data:      d,
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	t.Log(resp.Data)
+	return resp
+}
+
+func TestBackend_updateAccountKeepsKeys(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "policyAccount", t)
+	originalAddress := ledgerAccount(td, "policyAccount", t)
+
+	exists, err := td.B.(*backend).pathAccountExistenceCheck(context.Background(), &logical.Request{
+		Path:    "accounts/policyAccount",
+		Storage: td.S,
+	}, nil)
+	if err != nil || !exists {
+		t.Fatalf("expected the account to exist: %v", err)
+	}
+
+	resp := updateAccount(td, "policyAccount", map[string]interface{}{
+		"tx_spend_limit": "500",
+		"whitelist":      "rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh",
+	}, t)
+	if *resp.Data["txSpendLimit"].(*string) != "500" {
+		t.Fatalf("expected the spend limit to be updated: %v", resp.Data)
+	}
+	if ledgerAccount(td, "policyAccount", t) != originalAddress {
+		t.Fatalf("expected the keys to be preserved on update")
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/policyAccount",
+		Data:      map[string]interface{}{"xrp_balance": "10"},
+		Storage:   td.S,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected xrp_balance to be rejected on update")
+	}
+
+	updateAccount(td, "policyAccount", map[string]interface{}{"replace_keys": true}, t)
+	if ledgerAccount(td, "policyAccount", t) == originalAddress {
+		t.Fatalf("expected replace_keys to generate new keys")
+	}
+}
+
+func TestBackend_replaceKeysKeepsPolicies(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "replacedTreasury", t)
+	originalAddress := ledgerAccount(td, "replacedTreasury", t)
+	fundedBalance := td.Ledger.accounts[originalAddress].Balance.String()
+
+	updateAccount(td, "replacedTreasury", map[string]interface{}{
+		"whitelist":             "rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh",
+		"blacklist":             "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf",
+		"currency_spend_limits": map[string]interface{}{"XRP": "200"},
+	}, t)
+	writeAccountPath(td, "replacedTreasury/velocity_limits/daily", map[string]interface{}{"window": "24h", "max_count": 10}, t)
+	writeAccountPath(td, "replacedTreasury/approval_policy", map[string]interface{}{"thresholds": map[string]interface{}{"XRP": "100"}}, t)
+	writeAccountPath(td, "replacedTreasury/regular_key", map[string]interface{}{"submit": true}, t)
+	writeAccountPath(td, "replacedTreasury/regular_key/confirm", map[string]interface{}{}, t)
+	writeAccountPath(td, "replacedTreasury/rotation", map[string]interface{}{"max_signatures": 5}, t)
+
+	updateAccount(td, "replacedTreasury", map[string]interface{}{"replace_keys": true}, t)
+	if ledgerAccount(td, "replacedTreasury", t) == originalAddress {
+		t.Fatalf("expected replace_keys to generate new keys")
+	}
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "replacedTreasury", t)); err == nil {
+		t.Fatalf("expected the new address not to be funded")
+	}
+	if td.Ledger.accounts[originalAddress].Balance.String() != fundedBalance {
+		t.Fatalf("expected nothing to be sent from the old address")
+	}
+
+	account, err := td.B.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/replacedTreasury")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.TxSpendLimit != "1000" || len(account.Whitelist) != 1 || len(account.Blacklist) != 1 ||
+		account.CurrencySpendLimits["XRP"] != "200" {
+		t.Fatalf("expected the spend policy to be kept: %+v", account)
+	}
+	if account.VelocityLimits["daily"] == nil || account.ApprovalPolicy == nil || account.RotationPolicy == nil {
+		t.Fatalf("expected the velocity limits, approval policy and rotation policy to be kept: %+v", account)
+	}
+	if account.RegularKey != nil || account.PendingRegularKey != nil || account.Wallet != "" {
+		t.Fatalf("expected the state of the old keys to be dropped: %+v", account)
+	}
+}
+
+func updateAccount(td *testData, accountName string, d map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("accounts/%s", accountName),
+		Data:      d,
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to update account: %v", err)
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	return resp
+}
+
+func TestBackend_sweepAndDeleteAccount(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "sweepSource", t)
+	createAccount(td, "sweepDestination", t)
+	sourceAddress := ledgerAccount(td, "sweepSource", t)
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/sweepSource/delete",
+		Data: map[string]interface{}{
+			"destination": "sweepDestination",
+			"submit":      true,
+		},
+		Storage: td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to sweep account: %v %v", err, resp)
+	}
+	if resp.Data["submitted"] != true {
+		t.Fatalf("expected the AccountDelete to be submitted: %v", resp.Data)
+	}
+	if _, ok := readSignedTransaction(t, resp.Data["signed_transaction"]).(*data.AccountDelete); !ok {
+		t.Fatalf("expected an AccountDelete transaction")
+	}
+	if _, err := td.Ledger.AccountInfo(sourceAddress); err == nil {
+		t.Fatalf("expected the account to be deleted from the ledger")
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/sweepSource/delete",
+		Data:      map[string]interface{}{"confirm": true},
+		Storage:   td.S,
+		EntityID:  "operator-1",
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to delete account: %v %v", err, resp)
+	}
+	if entry, _ := td.S.Get(context.Background(), "accounts/sweepSource"); entry != nil {
+		t.Fatalf("expected the account to be removed from storage")
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tombstones/" + sourceAddress.String(),
+		Storage:   td.S,
+	})
+	if err != nil || resp == nil {
+		t.Fatalf("expected a tombstone: %v", err)
+	}
+	if resp.Data["name"] != "sweepSource" || resp.Data["deleted_by"] != "operator-1" || resp.Data["sweep_tx_hash"] == "" {
+		t.Fatalf("unexpected tombstone: %v", resp.Data)
+	}
+}
+
+func TestBackend_sweepSpendLimit(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "limitedSweep", t)
+	createAccount(td, "limitedSweepDestination", t)
+	updateAccount(td, "limitedSweep", map[string]interface{}{"tx_spend_limit": "40"}, t)
+
+	sweep := func(d map[string]interface{}) (*logical.Response, error) {
+		d["destination"] = "limitedSweepDestination"
+		return td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "accounts/limitedSweep/delete",
+			Data:      d,
+			Storage:   td.S,
+		})
+	}
+
+	// The sweep moves the balance of 50 XRP less the fee, which is over the limit
+	resp, err := sweep(map[string]interface{}{})
+	expectPolicyDenied(t, resp, err)
+
+	// Offline the balance cannot be checked, so the sweep needs force
+	resp, err = sweep(map[string]interface{}{"offline": true, "sequence": 1})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected an offline sweep of a limited account to be refused: %v %v", err, resp)
+	}
+	resp, err = sweep(map[string]interface{}{"offline": true, "sequence": 1, "force": true})
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected a forced offline sweep to be signed: %v %v", err, resp)
+	}
+
+	// The sweep is also held to the velocity limits, and counted towards them
+	updateAccount(td, "limitedSweep", map[string]interface{}{"tx_spend_limit": "50"}, t)
+	writeAccountPath(td, "limitedSweep/velocity_limits/daily", map[string]interface{}{"window": "24h", "max_amount": "40"}, t)
+	resp, err = sweep(map[string]interface{}{})
+	expectPolicyDenied(t, resp, err)
+
+	writeAccountPath(td, "limitedSweep/velocity_limits/daily", map[string]interface{}{"window": "24h", "max_amount": "100"}, t)
+	resp, err = sweep(map[string]interface{}{"submit": true})
+	if err != nil || resp.IsError() || resp.Data["submitted"] != true {
+		t.Fatalf("expected a sweep within the limits to be submitted: %v %v", err, resp)
+	}
+	resp = readAccountPath(td, "limitedSweep/velocity_limits/daily", t)
+	if resp.Data["amount"] != "49.8" || resp.Data["count"] != uint64(1) {
+		t.Fatalf("expected the sweep to be recorded: %v", resp.Data)
+	}
+}
+
+func TestBackend_deleteFundedAccountRequiresForce(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "fundedAccount", t)
+
+	deleteAccount := func(name string) (*logical.Response, error) {
+		return td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "accounts/" + name,
+			Storage:   td.S,
+		})
+	}
+
+	// The account was never swept and still exists on the ledger, so its keys are kept
+	resp, err := deleteAccount("fundedAccount")
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected deleting a funded account to be refused: %v %v", err, resp)
+	}
+	if entry, _ := td.S.Get(context.Background(), "accounts/fundedAccount"); entry == nil {
+		t.Fatalf("expected the account to be kept")
+	}
+
+	// An account that never made it onto the ledger can be deleted directly
+	writeConfig(td, map[string]interface{}{"funding_mode": fundingModeNone}, t)
+	createAccount(td, "unfundedAccount", t)
+	resp, err = deleteAccount("unfundedAccount")
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected deleting an account missing from the ledger to succeed: %v %v", err, resp)
+	}
+	if entry, _ := td.S.Get(context.Background(), "accounts/unfundedAccount"); entry != nil {
+		t.Fatalf("expected the account to be removed from storage")
+	}
+}
+
+func TestBackend_deleteAccountRequiresValidatedSweep(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "unsweptSource", t)
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/unsweptSource/delete",
+		Data:      map[string]interface{}{"destination": "rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh"},
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to sign AccountDelete: %v %v", err, resp)
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "accounts/unsweptSource",
+		Storage:   td.S,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected deletion to be refused before the sweep is validated")
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/unsweptSource/delete",
+		Data:      map[string]interface{}{"confirm": true, "force": true},
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected a forced deletion to succeed: %v %v", err, resp)
+	}
+}
+
+func TestBackend_importAccount(t *testing.T) {
+	td := setupTest(t)
+
+	seed, err := crypto.GenerateFamilySeed("importedFromSeed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedAccount, err := accountFromSeed(keyTypeSecp256k1, seed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := importAccount(td, "importedFromSeed", map[string]interface{}{
+		"seed":             seed.String(),
+		"expected_address": seedAccount.AccountId,
+	}, t)
+	if resp.IsError() {
+		t.Fatalf("failed to import account from seed: %v", resp.Error())
+	}
+	if resp.Data["accountId"] != seedAccount.AccountId {
+		t.Fatalf("expected address %s, got %v", seedAccount.AccountId, resp.Data["accountId"])
+	}
+
+	resp = importAccount(td, "importedFromSeed", map[string]interface{}{"seed": seed.String()}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected importing over an existing account to fail")
+	}
+
+	resp = importAccount(td, "wrongAddress", map[string]interface{}{
+		"seed":             seed.String(),
+		"expected_address": "rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh",
+	}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected an address mismatch to fail the import")
+	}
+	if entry, _ := td.S.Get(context.Background(), "accounts/wrongAddress"); entry != nil {
+		t.Fatalf("expected nothing to be stored on an address mismatch")
+	}
+}
+
+func TestBackend_importAccountFromPrivateKey(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "importFunder", t)
+
+	seed, err := crypto.GenerateFamilySeed("importedFromKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.NewECDSAKey(seed.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySequenceZero := uint32(0)
+	accountId, err := crypto.AccountId(key, &keySequenceZero)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := importAccount(td, "importedFromKey", map[string]interface{}{
+		"private_key":      "00" + hex.EncodeToString(key.Private(&keySequenceZero)),
+		"expected_address": accountId.String(),
+	}, t)
+	if resp.IsError() {
+		t.Fatalf("failed to import account from private key: %v", resp.Error())
+	}
+
+	// Importing must not fund the account, so fund it and check the imported key can sign
+	if _, err := td.Ledger.AccountInfo(ledgerAccount(td, "importedFromKey", t)); err == nil {
+		t.Fatalf("expected the imported account not to be funded")
+	}
+	submitSignedTransaction(td, createPayment(td, "importFunder", "importedFromKey", "100", t)["signed_transaction"], t)
+	submitSignedTransaction(td, createPayment(td, "importedFromKey", "importFunder", "10", t)["signed_transaction"], t)
+}
+
+func TestBackend_importAccountFromRFC1751(t *testing.T) {
+	td := setupTest(t)
+
+	// The words wallet_propose shows for the genesis account's seed, snoPBrXtMeMyMHUVTgbuqAfg1SUTb
+	resp := importAccount(td, "genesis", map[string]interface{}{
+		"rfc1751":          "I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS DARE",
+		"expected_address": "rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh",
+	}, t)
+	if resp.IsError() {
+		t.Fatalf("failed to import account from RFC1751 words: %v", resp.Error())
+	}
+
+	resp = importAccount(td, "badWords", map[string]interface{}{
+		"rfc1751": "I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS DARK",
+	}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected words failing the parity check to be rejected")
+	}
+
+	resp = importAccount(td, "twoSecrets", map[string]interface{}{
+		"rfc1751": "I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS DARE",
+		"seed":    "snoPBrXtMeMyMHUVTgbuqAfg1SUTb",
+	}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected an import with both a seed and words to fail")
+	}
+}
+
+func importAccount(td *testData, accountName string, d map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/" + accountName + "/import",
+		Data:      d,
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to import account: %v", err)
+	}
+	return resp
+}
+
+func TestBackend_ed25519Account(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "secpAccount", t)
+
+	resp := createAccountWithData(td, "edAccount", map[string]interface{}{
+		"xrp_balance":    "50",
+		"tx_spend_limit": "1000",
+		"key_type":       keyTypeEd25519,
+	}, t)
+	if resp.Data["keyType"] != keyTypeEd25519 {
+		t.Fatalf("expected an ed25519 account: %v", resp.Data)
+	}
+	if publicKey, _ := crypto.NewRippleHashCheck(resp.Data["publicKey"].(string), crypto.RIPPLE_ACCOUNT_PUBLIC); publicKey == nil || publicKey.Payload()[0] != 0xED {
+		t.Fatalf("expected an ED prefixed public key: %v", resp.Data["publicKey"])
+	}
+
+	stored, err := td.B.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/edAccount")
+	if err != nil || !strings.HasPrefix(stored.Secret, "sEd") {
+		t.Fatalf("expected the seed of an ed25519 account to be encoded as sEd...: %v", err)
+	}
+
+	submitSignedTransaction(td, createPayment(td, "edAccount", "secpAccount", "10", t)["signed_transaction"], t)
+
+	// Replacing the keys keeps the key type unless another one is requested
+	resp = updateAccount(td, "edAccount", map[string]interface{}{"replace_keys": true}, t)
+	if resp.Data["keyType"] != keyTypeEd25519 {
+		t.Fatalf("expected replace_keys to keep the key type: %v", resp.Data)
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/badKeyType",
+		Data:      map[string]interface{}{"key_type": "rsa"},
+		Storage:   td.S,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected an unknown key_type to be rejected")
+	}
+}
+
+func TestBackend_importEd25519PrivateKey(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "edFunder", t)
+
+	privateKey := "ED" + hex.EncodeToString(bytes.Repeat([]byte{0x42}, 32))
+	resp := importAccount(td, "edImported", map[string]interface{}{"private_key": privateKey}, t)
+	if resp.IsError() {
+		t.Fatalf("failed to import ed25519 key: %v", resp.Error())
+	}
+	if resp.Data["keyType"] != keyTypeEd25519 {
+		t.Fatalf("expected an ed25519 account: %v", resp.Data)
+	}
+
+	submitSignedTransaction(td, createPayment(td, "edFunder", "edImported", "100", t)["signed_transaction"], t)
+	submitSignedTransaction(td, createPayment(td, "edImported", "edFunder", "10", t)["signed_transaction"], t)
+}
+
+func TestBackend_importEd25519Seed(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "edSeedFunder", t)
+
+	// sEd seeds derive an Ed25519 key without key_type being set
+	resp := importAccount(td, "edSeedImported", map[string]interface{}{"seed": "sEdTM1uX8pu2do5XvTnutH6HsouMaM2"}, t)
+	if resp.IsError() {
+		t.Fatalf("failed to import ed25519 seed: %v", resp.Error())
+	}
+	if resp.Data["keyType"] != keyTypeEd25519 {
+		t.Fatalf("expected an ed25519 account: %v", resp.Data)
+	}
+
+	submitSignedTransaction(td, createPayment(td, "edSeedFunder", "edSeedImported", "100", t)["signed_transaction"], t)
+	submitSignedTransaction(td, createPayment(td, "edSeedImported", "edSeedFunder", "10", t)["signed_transaction"], t)
+}
+
+func TestBackend_walletDerivation(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "walletFunder", t)
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "wallets/deposits",
+		Data: map[string]interface{}{
+			"mnemonic": "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		},
+		Storage: td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to create wallet: %v %v", err, resp)
+	}
+	if _, ok := resp.Data["mnemonic"]; ok {
+		t.Fatalf("expected the mnemonic not to be returned")
+	}
+
+	resp = deriveWalletAccount(td, "deposits", map[string]interface{}{"account_name": "deposit0"}, t)
+	if resp.Data["accountId"] != "rHsMGQEkVNJmpGWs8XUBoTBiAAbwxZN5v3" || resp.Data["derivationPath"] != "m/44'/144'/0'/0/0" {
+		t.Fatalf("unexpected derived account: %v", resp.Data)
+	}
+	resp = deriveWalletAccount(td, "deposits", map[string]interface{}{"account_name": "deposit1"}, t)
+	if resp.Data["walletIndex"] != uint32(1) {
+		t.Fatalf("expected the next unused index to be derived: %v", resp.Data)
+	}
+	resp = deriveWalletAccount(td, "deposits", map[string]interface{}{"account_name": "depositCopy", "index": 0}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected deriving an index twice to fail")
+	}
+
+	// Derived accounts keep no key material of their own
+	entry, err := td.S.Get(context.Background(), "accounts/deposit0")
+	if err != nil || entry == nil {
+		t.Fatalf("expected the derived account to be stored: %v", err)
+	}
+	var account Account
+	if err := entry.DecodeJSON(&account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Secret != "" || account.PrivateKey != "" {
+		t.Fatalf("expected no key material to be stored for a derived account")
+	}
+
+	submitSignedTransaction(td, createPayment(td, "walletFunder", "deposit0", "100", t)["signed_transaction"], t)
+	submitSignedTransaction(td, createPayment(td, "deposit0", "walletFunder", "10", t)["signed_transaction"], t)
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "wallets/deposits",
+		Storage:   td.S,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected deleting a wallet with derived accounts to fail")
+	}
+}
+
+func deriveWalletAccount(td *testData, walletName string, d map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "wallets/" + walletName + "/derive",
+		Data:      d,
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	return resp
+}
+
+func TestBackend_regularKey(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "hotWallet", t)
+	createAccount(td, "coldWallet", t)
+
+	resp := writeAccountPath(td, "hotWallet/disable_master", map[string]interface{}{"submit": true}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected disabling the master key without a regular key to fail")
+	}
+
+	resp = writeAccountPath(td, "hotWallet/regular_key", map[string]interface{}{"submit": true}, t)
+	if resp.IsError() || resp.Data["submitted"] != true {
+		t.Fatalf("failed to set regular key: %v", resp.Data)
+	}
+	regularKey := resp.Data["regular_key"]
+
+	// The master key keeps signing until the regular key is confirmed
+	signedTx := createPayment(td, "hotWallet", "coldWallet", "1", t)["signed_transaction"]
+	if signerOf(t, signedTx) != ledgerAccount(td, "hotWallet", t).String() {
+		t.Fatalf("expected the master key to sign before confirmation")
+	}
+	submitSignedTransaction(td, signedTx, t)
+
+	resp = writeAccountPath(td, "hotWallet/regular_key/confirm", map[string]interface{}{}, t)
+	if resp.IsError() || resp.Data["regular_key"] != regularKey {
+		t.Fatalf("failed to confirm regular key: %v", resp.Data)
+	}
+
+	resp = writeAccountPath(td, "hotWallet/disable_master", map[string]interface{}{"submit": true}, t)
+	if resp.IsError() || resp.Data["submitted"] != true {
+		t.Fatalf("failed to disable the master key: %v", resp.Data)
+	}
+
+	// With the master key disabled, the ledger only accepts transactions signed with the regular key
+	signedTx = createPayment(td, "hotWallet", "coldWallet", "1", t)["signed_transaction"]
+	if signer := signerOf(t, signedTx); signer != regularKey {
+		t.Fatalf("expected the regular key %v to sign, got %s", regularKey, signer)
+	}
+	submitSignedTransaction(td, signedTx, t)
+}
+
+func TestBackend_pendingRegularKey(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "pendingWallet", t)
+	createAccount(td, "pendingDestination", t)
+
+	writeAccountPath(td, "pendingWallet/regular_key", map[string]interface{}{"submit": true}, t)
+	resp := writeAccountPath(td, "pendingWallet/regular_key/confirm", map[string]interface{}{}, t)
+	activeKey := resp.Data["regular_key"]
+
+	// A SetRegularKey that is signed but not submitted may still be validated
+	resp = writeAccountPath(td, "pendingWallet/regular_key", map[string]interface{}{}, t)
+	pendingKey := resp.Data["regular_key"]
+	resp = writeAccountPath(td, "pendingWallet/regular_key", map[string]interface{}{}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected a new regular key to be refused while one is pending")
+	}
+	resp = writeAccountPath(td, "pendingWallet/disable_master", map[string]interface{}{"submit": true}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected disabling the master key to be refused while a regular key is pending")
+	}
+	resp = readAccountPath(td, "pendingWallet/regular_key", t)
+	if resp.Data["regular_key"] != activeKey || resp.Data["pending_regular_key"] != pendingKey {
+		t.Fatalf("expected the refused requests to leave the keys alone: %v", resp.Data)
+	}
+
+	// The pending key can be discarded explicitly
+	resp = writeAccountPath(td, "pendingWallet/regular_key", map[string]interface{}{
+		"cancel_pending":       true,
+		"last_ledger_sequence": int(td.Ledger.ledgerSequence),
+	}, t)
+	if resp.IsError() || resp.Data["regular_key"] == pendingKey {
+		t.Fatalf("expected cancel_pending to replace the pending key: %v", resp.Data)
+	}
+
+	// Once the ledger is past its LastLedgerSequence, the pending SetRegularKey has failed and can be replaced
+	submitSignedTransaction(td, createPayment(td, "pendingWallet", "pendingDestination", "1", t)["signed_transaction"], t)
+	resp = writeAccountPath(td, "pendingWallet/regular_key", map[string]interface{}{"submit": true}, t)
+	if resp.IsError() || resp.Data["submitted"] != true {
+		t.Fatalf("expected an expired pending key to be replaced: %v", resp.Data)
+	}
+}
+
+// signerOf returns the address of the key that signed the transaction
+func signerOf(t *testing.T, signedTx interface{}) string {
+	var signer data.RegularKey
+	copy(signer[:], sha256RipeMD160(readSignedTransaction(t, signedTx).GetBase().SigningPubKey[:]))
+	return signer.String()
+}
+
+func writeAccountPath(td *testData, path string, d map[string]interface{}, t *testing.T) *logical.Response {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/" + path,
+		Data:      d,
+		Storage:   td.S,
+	})
+	if err != nil {
+		t.Fatalf("request to accounts/%s failed: %v", path, err)
+	}
+	return resp
+}
+
+func TestBackend_regularKeyRotation(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "rotatingWallet", t)
+	createAccount(td, "rotationDestination", t)
+
+	resp := writeAccountPath(td, "rotatingWallet/rotation", map[string]interface{}{"max_signatures": 1}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected a rotation policy to require an active regular key")
+	}
+
+	writeAccountPath(td, "rotatingWallet/regular_key", map[string]interface{}{"submit": true}, t)
+	resp = writeAccountPath(td, "rotatingWallet/regular_key/confirm", map[string]interface{}{}, t)
+	originalKey := resp.Data["regular_key"]
+
+	resp = writeAccountPath(td, "rotatingWallet/rotation", map[string]interface{}{"max_signatures": 1}, t)
+	if resp.IsError() {
+		t.Fatalf("failed to set rotation policy: %v", resp.Error())
+	}
+
+	runPeriodic := func() {
+		err := td.B.(*backend).periodicFunc(context.Background(), &logical.Request{Storage: td.S})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is due until the key has signed
+	runPeriodic()
+	resp = readAccountPath(td, "rotatingWallet/regular_key", t)
+	if _, ok := resp.Data["pending_regular_key"]; ok {
+		t.Fatalf("expected no rotation before the key is due")
+	}
+
+	submitSignedTransaction(td, createPayment(td, "rotatingWallet", "rotationDestination", "1", t)["signed_transaction"], t)
+
+	// The first run submits the SetRegularKey signed by the old key, the second activates the new key
+	runPeriodic()
+	resp = readAccountPath(td, "rotatingWallet/regular_key", t)
+	if resp.Data["regular_key"] != originalKey || resp.Data["pending_regular_key"] == nil {
+		t.Fatalf("expected a pending rotation: %v", resp.Data)
+	}
+	runPeriodic()
+	resp = readAccountPath(td, "rotatingWallet/regular_key", t)
+	newKey := resp.Data["regular_key"]
+	if newKey == originalKey || resp.Data["pending_regular_key"] != nil {
+		t.Fatalf("expected the rotation to complete: %v", resp.Data)
+	}
+	history := resp.Data["history"].([]*RetiredRegularKey)
+	if len(history) != 1 || history[0].AccountId != originalKey || history[0].Signatures != 2 {
+		t.Fatalf("expected the old key to be retired into the history: %v", history)
+	}
+
+	signedTx := createPayment(td, "rotatingWallet", "rotationDestination", "1", t)["signed_transaction"]
+	if signerOf(t, signedTx) != newKey {
+		t.Fatalf("expected the new regular key to sign")
+	}
+	submitSignedTransaction(td, signedTx, t)
+}
+
+func TestBackend_regularKeyRotationExpires(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "stuckWallet", t)
+	createAccount(td, "stuckDestination", t)
+
+	writeAccountPath(td, "stuckWallet/regular_key", map[string]interface{}{"submit": true}, t)
+	resp := writeAccountPath(td, "stuckWallet/regular_key/confirm", map[string]interface{}{}, t)
+	originalKey := resp.Data["regular_key"]
+	writeAccountPath(td, "stuckWallet/rotation", map[string]interface{}{"max_signatures": 1}, t)
+	submitSignedTransaction(td, createPayment(td, "stuckWallet", "stuckDestination", "1", t)["signed_transaction"], t)
+
+	runPeriodic := func() {
+		err := td.B.(*backend).periodicFunc(context.Background(), &logical.Request{Storage: td.S})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rotation is queued but never validated
+	td.Ledger.holdSubmissions = true
+	runPeriodic()
+	resp = readAccountPath(td, "stuckWallet/regular_key", t)
+	pendingKey := resp.Data["pending_regular_key"]
+	if pendingKey == nil {
+		t.Fatalf("expected a pending rotation: %v", resp.Data)
+	}
+
+	// While the SetRegularKey can still be validated the pending key is kept, however long it takes
+	account, err := td.B.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/stuckWallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.PendingRegularKey.CreatedAt = time.Now().Add(-24 * time.Hour)
+	err = td.B.(*backend).writeVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/stuckWallet", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runPeriodic()
+	resp = readAccountPath(td, "stuckWallet/regular_key", t)
+	if resp.Data["pending_regular_key"] != pendingKey {
+		t.Fatalf("expected the pending key to be kept while its outcome is unknown: %v", resp.Data)
+	}
+
+	// Past its LastLedgerSequence the rotation has failed, so it is abandoned and a new one is started
+	td.Ledger.ledgerSequence += rotationLedgerWindow + 1
+	td.Ledger.holdSubmissions = false
+	runPeriodic()
+	resp = readAccountPath(td, "stuckWallet/regular_key", t)
+	if resp.Data["regular_key"] != originalKey || resp.Data["pending_regular_key"] != nil {
+		t.Fatalf("expected the expired rotation to be abandoned: %v", resp.Data)
+	}
+	runPeriodic()
+	runPeriodic()
+	resp = readAccountPath(td, "stuckWallet/regular_key", t)
+	if newKey := resp.Data["regular_key"]; newKey == originalKey || newKey == pendingKey {
+		t.Fatalf("expected a new rotation to complete: %v", resp.Data)
+	}
+}
+
+func TestBackend_rotationPolicyWriteDuringRotation(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "busyWallet", t)
+	createAccount(td, "busyDestination", t)
+
+	writeAccountPath(td, "busyWallet/regular_key", map[string]interface{}{"submit": true}, t)
+	writeAccountPath(td, "busyWallet/regular_key/confirm", map[string]interface{}{}, t)
+	writeAccountPath(td, "busyWallet/rotation", map[string]interface{}{"max_signatures": 1}, t)
+	submitSignedTransaction(td, createPayment(td, "busyWallet", "busyDestination", "1", t)["signed_transaction"], t)
+
+	// Change the policy while the rotation is between reading the account and storing the new key
+	var wg sync.WaitGroup
+	var policyResp *logical.Response
+	var policyErr error
+	td.Ledger.onServerInfo = func() {
+		td.Ledger.onServerInfo = nil
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			policyResp, policyErr = td.B.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "accounts/busyWallet/rotation",
+				Data:      map[string]interface{}{"max_signatures": 5},
+				Storage:   td.S,
+			})
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	b := td.B.(*backend)
+	config, err := b.readConfig(context.Background(), td.S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.rotateRegularKey(context.Background(), &logical.Request{Storage: td.S}, config, "busyWallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if policyErr != nil || policyResp.IsError() {
+		t.Fatalf("failed to write rotation policy: %v %v", policyErr, policyResp)
+	}
+
+	// Both changes are kept
+	account, err := b.readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/busyWallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.PendingRegularKey == nil || account.PendingRegularKey.Secret == "" {
+		t.Fatalf("expected the pending regular key to be kept: %v", account.PendingRegularKey)
+	}
+	if account.RotationPolicy.MaxSignatures != 5 {
+		t.Fatalf("expected the new rotation policy to be kept: %v", account.RotationPolicy)
+	}
+}
+
+func TestBackend_accountUpdateDuringSweep(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "busySweep", t)
+	createAccount(td, "busySweepDestination", t)
+
+	// Change the spend limit while the sweep is between reading the account and storing its hash
+	var wg sync.WaitGroup
+	var updateResp *logical.Response
+	var updateErr error
+	td.Ledger.onAccountInfo = func() {
+		td.Ledger.onAccountInfo = nil
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			updateResp, updateErr = td.B.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "accounts/busySweep",
+				Data:      map[string]interface{}{"tx_spend_limit": "1000"},
+				Storage:   td.S,
+			})
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/busySweep/delete",
+		Data:      map[string]interface{}{"destination": "busySweepDestination"},
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to sweep account: %v %v", err, resp)
+	}
+	wg.Wait()
+	if updateErr != nil || updateResp.IsError() {
+		t.Fatalf("failed to update account: %v %v", updateErr, updateResp)
+	}
+
+	// Both changes are kept
+	b := td.B.(*backend)
+	account, err := b.readVaultAccount(context.Background(), &logical.Request{Storage: td.S}, "accounts/busySweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.SweepTxHash == "" {
+		t.Fatalf("expected the sweep to be recorded")
+	}
+	if account.TxSpendLimit != "1000" {
+		t.Fatalf("expected the new spend limit to be kept: %v", account.TxSpendLimit)
+	}
+}
+
+func readAccountPath(td *testData, path string, t *testing.T) *logical.Response {
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/" + path,
+		Storage:   td.S,
+	})
+	if err != nil || resp == nil {
+		t.Fatalf("failed to read accounts/%s: %v", path, err)
+	}
+	return resp
+}
+
+func TestBackend_readCorruptAccount(t *testing.T) {
+	td := setupTest(t)
+	err := td.S.Put(context.Background(), &logical.StorageEntry{Key: "accounts/corrupt", Value: []byte("{not json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken entry fails the request instead of taking down the plugin
+	_, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/corrupt",
+		Storage:   td.S,
+	})
+	if err == nil {
+		t.Fatalf("expected reading a corrupt account to fail")
+	}
+}
+
+func TestBackend_encryptedAccountStorage(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "plainAccount", t)
+
+	// Without a mount key accounts are stored as JSON, but never with the private key
+	entry, err := td.S.Get(context.Background(), "accounts/plainAccount")
+	if err != nil || entry == nil {
+		t.Fatalf("expected the account to be stored: %v", err)
+	}
+	if bytes.Contains(entry.Value, []byte("private_key")) {
+		t.Fatalf("expected the private key not to be stored: %s", entry.Value)
+	}
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/mount_key/rotate",
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() || resp.Data["current_version"] != 1 {
+		t.Fatalf("failed to create mount key: %v %v", err, resp)
+	}
+
+	createAccount(td, "encryptedAccount", t)
+	entry, err = td.S.Get(context.Background(), "accounts/encryptedAccount")
+	if err != nil || entry == nil {
+		t.Fatalf("expected the account to be stored: %v", err)
+	}
+	if bytes.Contains(entry.Value, []byte("secret")) || !bytes.Contains(entry.Value, []byte("envelope_ciphertext")) {
+		t.Fatalf("expected the account to be encrypted: %s", entry.Value)
+	}
+
+	// Both accounts are readable and can sign
+	submitSignedTransaction(td, createPayment(td, "encryptedAccount", "plainAccount", "1", t)["signed_transaction"], t)
+	submitSignedTransaction(td, createPayment(td, "plainAccount", "encryptedAccount", "1", t)["signed_transaction"], t)
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/mount_key/rotate",
+		Data:      map[string]interface{}{"rewrap": true},
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to rotate mount key: %v %v", err, resp)
+	}
+	if resp.Data["current_version"] != 2 || resp.Data["rewrapped"] != 2 || len(resp.Data["versions"].([]int)) != 1 {
+		t.Fatalf("unexpected rotation result: %v", resp.Data)
+	}
+
+	entry, err = td.S.Get(context.Background(), "accounts/plainAccount")
+	if err != nil || entry == nil {
+		t.Fatalf("expected the account to be stored: %v", err)
+	}
+	if !bytes.Contains(entry.Value, []byte(`"envelope_key_version":2`)) {
+		t.Fatalf("expected the account to be re-encrypted with the new key: %s", entry.Value)
+	}
+	submitSignedTransaction(td, createPayment(td, "plainAccount", "encryptedAccount", "1", t)["signed_transaction"], t)
+}
+
+func TestBackend_paymentToExternalAddress(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "externalSource", t)
+
+	// A classic address outside the mount
+	external, err := data.NewAccountFromAddress("rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respData := createPayment(td, "externalSource", external.String(), "100", t)
+	submitSignedTransaction(td, respData["signed_transaction"], t)
+	if _, ok := td.Ledger.accounts[*external]; !ok {
+		t.Fatalf("expected the payment to fund %s", external.String())
+	}
+
+	// An X-address on the configured test network carries its destination tag into the payment
+	tag := uint32(12345)
+	respData = createPayment(td, "externalSource", encodeXAddress(*external, &tag, false), "10", t)
+	payment := readSignedTransaction(t, respData["signed_transaction"]).(*data.Payment)
+	if payment.Destination != *external || payment.DestinationTag == nil || *payment.DestinationTag != tag {
+		t.Fatalf("expected a payment to %s with tag %d: %v", external.String(), tag, payment)
+	}
+	if respData["destination_tag"] != tag {
+		t.Fatalf("expected the destination tag in the response: %v", respData)
+	}
+	submitSignedTransaction(td, respData["signed_transaction"], t)
+
+	// A main network X-address is refused on the test network
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "payments",
+		Data: map[string]interface{}{
+			"source":      "externalSource",
+			"destination": encodeXAddress(*external, &tag, true),
+			"assetCode":   "native",
+			"amount":      "10",
+		},
+		Storage: td.S,
+	})
+	if err == nil && !resp.IsError() {
+		t.Fatalf("expected a main network X-address to be refused")
+	}
+}
+
+func TestBackend_paymentTagsAndInvoiceId(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "taggedSource", t)
+	createAccount(td, "taggedDestination", t)
+
+	invoiceId := "6F1DFD1D0FE8A32E40E1F2C05CF1C15545BAB56B617F9C6C2D63A6B704BEF59B"
+	respData := createPaymentWithData(td, map[string]interface{}{
+		"source":          "taggedSource",
+		"destination":     "taggedDestination",
+		"assetCode":       "native",
+		"amount":          "10",
+		"destination_tag": 4294967295,
+		"source_tag":      7,
+		"invoice_id":      invoiceId,
+	}, t)
+	if respData["destination_tag"] != uint32(4294967295) || respData["source_tag"] != uint32(7) || respData["invoice_id"] != invoiceId {
+		t.Fatalf("expected the tags and invoice id in the response: %v", respData)
+	}
+	payment := readSignedTransaction(t, respData["signed_transaction"]).(*data.Payment)
+	if payment.DestinationTag == nil || *payment.DestinationTag != 4294967295 ||
+		payment.SourceTag == nil || *payment.SourceTag != 7 ||
+		payment.InvoiceID == nil || payment.InvoiceID.String() != invoiceId {
+		t.Fatalf("expected the tags and invoice id in the signed payment: %v", payment)
+	}
+	submitSignedTransaction(td, respData["signed_transaction"], t)
+
+	// Out of range tags, malformed invoice ids and tags conflicting with an X-address are refused
+	external, err := data.NewAccountFromAddress("rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xAddressTag := uint32(1)
+	for _, invalid := range []map[string]interface{}{
+		{"destination_tag": 4294967296},
+		{"destination_tag": -1},
+		{"source_tag": 4294967296},
+		{"invoice_id": "6F1DFD1D"},
+		{"invoice_id": "not hex"},
+		{"destination": encodeXAddress(*external, &xAddressTag, false), "destination_tag": 2},
+	} {
+		d := map[string]interface{}{
+			"source":      "taggedSource",
+			"destination": "taggedDestination",
+			"assetCode":   "native",
+			"amount":      "10",
+		}
+		for k, v := range invalid {
+			d[k] = v
+		}
+		resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "payments",
+			Data:      d,
+			Storage:   td.S,
+		})
+		if err == nil && !resp.IsError() {
+			t.Fatalf("expected %v to be refused", invalid)
+		}
+	}
+}
+
+func TestBackend_memos(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "memoSource", t)
+	createAccount(td, "memoDestination", t)
+
+	// Payments take a text memo and a list of memos in text or hex
+	respData := createPaymentWithData(td, map[string]interface{}{
+		"source":      "memoSource",
+		"destination": "memoDestination",
+		"assetCode":   "native",
+		"amount":      "10",
+		"memo":        "rent",
+		"memos": []interface{}{
+			map[string]interface{}{"type": "invoice", "format": "text/plain", "data": "2019-04"},
+			`{"data": "DEADBEEF", "encoding": "hex"}`,
+		},
+	}, t)
+	payment := readSignedTransaction(t, respData["signed_transaction"]).(*data.Payment)
+	if len(payment.Memos) != 3 {
+		t.Fatalf("expected three memos: %v", payment.Memos)
+	}
+	if string(payment.Memos[0].Memo.MemoData) != "rent" ||
+		string(payment.Memos[1].Memo.MemoType) != "invoice" ||
+		string(payment.Memos[1].Memo.MemoFormat) != "text/plain" ||
+		string(payment.Memos[1].Memo.MemoData) != "2019-04" ||
+		!bytes.Equal(payment.Memos[2].Memo.MemoData, []byte{0xDE, 0xAD, 0xBE, 0xEF}) {
+		t.Fatalf("unexpected memos: %v", payment.Memos)
+	}
+	submitSignedTransaction(td, respData["signed_transaction"], t)
+
+	// AccountSet and TrustSet take the same fields
+	resp := writeAccountPath(td, "memoSource/accountset", map[string]interface{}{"domain": "chainfront.io", "memo": "domain"}, t)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	if memos := readSignedTransaction(t, resp.Data["signed_transaction"]).GetBase().Memos; len(memos) != 1 || string(memos[0].Memo.MemoData) != "domain" {
+		t.Fatalf("expected a memo on the AccountSet: %v", memos)
+	}
+	resp = writeAccountPath(td, "memoDestination/trustline", map[string]interface{}{
+		"currencyCode": "SRC",
+		"issuer":       readAccountPath(td, "memoSource", t).Data["accountId"],
+		"limit":        "1000",
+		"memo":         "trust",
+	}, t)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	if memos := readSignedTransaction(t, resp.Data["signed_transaction"]).GetBase().Memos; len(memos) != 1 || string(memos[0].Memo.MemoData) != "trust" {
+		t.Fatalf("expected a memo on the TrustSet: %v", memos)
+	}
+
+	// Memos too large for the ledger are refused before signing
+	resp = writeAccountPath(td, "memoSource/accountset", map[string]interface{}{"memo": string(make([]byte, maxMemosSize))}, t)
+	if !resp.IsError() {
+		t.Fatalf("expected an oversized memo to be refused")
+	}
+}
+
+func TestBackend_spendPolicy(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "policySource", t)
+	createAccount(td, "policyAllowed", t)
+	createAccount(td, "policyDenied", t)
+	allowed := readAccountPath(td, "policyAllowed", t).Data["accountId"].(string)
+	denied := readAccountPath(td, "policyDenied", t).Data["accountId"].(string)
+
+	payment := func(destination string, amount string) map[string]interface{} {
+		return map[string]interface{}{
+			"source":      "policySource",
+			"destination": destination,
+			"assetCode":   "native",
+			"amount":      amount,
+		}
+	}
+
+	// Blacklisted destinations are refused, whether given as a Vault account, an address or an X-address
+	updateAccount(td, "policySource", map[string]interface{}{"blacklist": denied}, t)
+	deniedAccount, err := data.NewAccountFromAddress(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, destination := range []string{"policyDenied", denied, encodeXAddress(*deniedAccount, nil, false)} {
+		resp, err := requestPayment(td, payment(destination, "1"))
+		expectPolicyDenied(t, resp, err)
+	}
+	createPayment(td, "policySource", "policyAllowed", "1", t)
+
+	// With a whitelist only listed destinations are allowed
+	updateAccount(td, "policySource", map[string]interface{}{"blacklist": "", "whitelist": allowed}, t)
+	createPayment(td, "policySource", allowed, "1", t)
+	resp, err := requestPayment(td, payment("rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", "1"))
+	expectPolicyDenied(t, resp, err)
+
+	// Sweeps are held to the same lists
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/policySource/delete",
+		Data:      map[string]interface{}{"destination": "policyDenied"},
+		Storage:   td.S,
+	})
+	expectPolicyDenied(t, resp, err)
+
+	// The XRP limit does not apply to issued currencies
+	updateAccount(td, "policySource", map[string]interface{}{"whitelist": ""}, t)
+	createPaymentWithData(td, map[string]interface{}{
+		"source":      "policySource",
+		"destination": "policyAllowed",
+		"assetCode":   "USD",
+		"assetIssuer": denied,
+		"amount":      "5000",
+	}, t)
+}
+
+func TestBackend_velocityLimits(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "velocitySource", t)
+	createAccount(td, "velocityDestination", t)
+	issuer := readAccountPath(td, "velocityDestination", t).Data["accountId"]
+
+	resp := writeAccountPath(td, "velocitySource/velocity_limits/daily", map[string]interface{}{"window": "24h", "max_amount": "100"}, t)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	resp = writeAccountPath(td, "velocitySource/velocity_limits/hourly", map[string]interface{}{"window": "1h", "max_count": 3}, t)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	createPayment(td, "velocitySource", "velocityDestination", "60", t)
+	resp, err := requestPayment(td, map[string]interface{}{
+		"source":      "velocitySource",
+		"destination": "velocityDestination",
+		"assetCode":   "native",
+		"amount":      "50",
+	})
+	expectPolicyDenied(t, resp, err)
+	createPayment(td, "velocitySource", "velocityDestination", "30", t)
+
+	// Issued currency payments count towards the number of payments but not the XRP sent
+	iouPayment := map[string]interface{}{
+		"source":      "velocitySource",
+		"destination": "velocityDestination",
+		"assetCode":   "USD",
+		"assetIssuer": issuer,
+		"amount":      "500",
+	}
+	createPaymentWithData(td, iouPayment, t)
+	resp, err = requestPayment(td, iouPayment)
+	expectPolicyDenied(t, resp, err)
+
+	velocityLimits := readAccountPath(td, "velocitySource", t).Data["velocityLimits"].(map[string]interface{})
+	daily := velocityLimits["daily"].(map[string]interface{})
+	hourly := velocityLimits["hourly"].(map[string]interface{})
+	if daily["amount"] != "90" || daily["maxAmount"] != "100" || hourly["count"] != uint64(3) || hourly["maxCount"] != uint64(3) {
+		t.Fatalf("unexpected velocity limit usage: %v", velocityLimits)
+	}
+
+	// Removing the limits allows payments again
+	for _, limit := range []string{"daily", "hourly"} {
+		_, err := td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "accounts/velocitySource/velocity_limits/" + limit,
+			Storage:   td.S,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	createPayment(td, "velocitySource", "velocityDestination", "50", t)
+
+	// Adding a limit back does not reset what was sent within its window
+	resp = writeAccountPath(td, "velocitySource/velocity_limits/daily", map[string]interface{}{"window": "24h", "max_amount": "100"}, t)
+	if resp.IsError() || resp.Data["amount"] != "90" {
+		t.Fatalf("expected the earlier payments to still count: %v", resp)
+	}
+	resp, err = requestPayment(td, map[string]interface{}{
+		"source":      "velocitySource",
+		"destination": "velocityDestination",
+		"assetCode":   "native",
+		"amount":      "20",
+	})
+	expectPolicyDenied(t, resp, err)
+}
+
+func TestBackend_currencySpendLimits(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "currencySource", t)
+	createAccount(td, "currencyDestination", t)
+	issuer := readAccountPath(td, "currencyDestination", t).Data["accountId"].(string)
+
+	resp := updateAccount(td, "currencySource", map[string]interface{}{
+		"currency_spend_limits": map[string]interface{}{
+			"xrp":           "5",
+			"USD/" + issuer: "100",
+			"EUR/" + issuer: 12.5,
+		},
+	}, t)
+	limits := readAccountPath(td, "currencySource", t).Data["currencySpendLimits"].(map[string]string)
+	if limits["XRP"] != "5" || limits["USD/"+issuer] != "100" || limits["EUR/"+issuer] != "12.5" {
+		t.Fatalf("unexpected currency spend limits: %v %v", limits, resp.Data)
+	}
+
+	payment := func(assetCode string, amount string) map[string]interface{} {
+		d := map[string]interface{}{
+			"source":      "currencySource",
+			"destination": "currencyDestination",
+			"assetCode":   assetCode,
+			"amount":      amount,
+		}
+		if assetCode != "native" {
+			d["assetIssuer"] = issuer
+		}
+		return d
+	}
+
+	// Each currency is held to its own limit, on top of tx_spend_limit for XRP
+	for _, denied := range []map[string]interface{}{payment("native", "5.1"), payment("USD", "100.01"), payment("EUR", "13")} {
+		resp, err := requestPayment(td, denied)
+		expectPolicyDenied(t, resp, err)
+	}
+	for _, allowed := range []map[string]interface{}{payment("native", "5"), payment("USD", "100"), payment("EUR", "12.5"), payment("GBP", "1000000")} {
+		createPaymentWithData(td, allowed, t)
+	}
+
+	// The limit applies to the hex form of a standard currency code, but codes are case-sensitive
+	resp, err := requestPayment(td, payment("0000000000000000000000005553440000000000", "100.01"))
+	expectPolicyDenied(t, resp, err)
+	createPaymentWithData(td, payment("usd", "100.01"), t)
+	updateAccount(td, "currencySource", map[string]interface{}{
+		"currency_spend_limits": map[string]interface{}{"gbp/" + issuer: "10"},
+	}, t)
+	limits = readAccountPath(td, "currencySource", t).Data["currencySpendLimits"].(map[string]string)
+	if limits["gbp/"+issuer] != "10" || limits["GBP/"+issuer] != "" {
+		t.Fatalf("expected the limit key to keep its case: %v", limits)
+	}
+	resp, err = requestPayment(td, payment("gbp", "11"))
+	expectPolicyDenied(t, resp, err)
+	createPaymentWithData(td, payment("GBP", "11"), t)
+
+	// Limits must be keyed by XRP or a currency and issuer, with positive amounts
+	for _, invalid := range []map[string]interface{}{
+		{"USD": "100"},
+		{"USD/notAnAddress": "100"},
+		{"XRP/" + issuer: "100"},
+		{"USD/" + issuer: "0"},
+		{"USD/" + issuer: "lots"},
+	} {
+		resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "accounts/currencySource",
+			Data:      map[string]interface{}{"currency_spend_limits": invalid},
+			Storage:   td.S,
+		})
+		if err == nil && !resp.IsError() {
+			t.Fatalf("expected %v to be refused", invalid)
+		}
+	}
+}
+
+func TestBackend_denylist(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "denylistSource", t)
+	createAccount(td, "denylistDestination", t)
+	denied := readAccountPath(td, "denylistDestination", t).Data["accountId"].(string)
+	deniedAccount, err := data.NewAccountFromAddress(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries can be added by X-address and are stored under the classic address
+	tag := uint32(99)
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "denylist/" + encodeXAddress(*deniedAccount, &tag, false),
+		Data:      map[string]interface{}{"reason": "test", "source": "unit tests"},
+		Storage:   td.S,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to add to the denylist: %v %v", err, resp)
+	}
+	if resp.Data["address"] != denied {
+		t.Fatalf("expected the entry to be stored under %s: %v", denied, resp.Data)
+	}
+
+	// Every way of naming the destination is refused, including X-addresses with other tags
+	otherTag := uint32(1)
+	for _, destination := range []string{"denylistDestination", denied, encodeXAddress(*deniedAccount, &otherTag, false)} {
+		resp, err := requestPayment(td, map[string]interface{}{
+			"source":      "denylistSource",
+			"destination": destination,
+			"assetCode":   "native",
+			"amount":      "1",
+		})
+		expectPolicyDenied(t, resp, err)
+	}
+
+	// So are trustlines to a denied issuer and payments in its currencies
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/denylistSource/trustline",
+		Data:      map[string]interface{}{"currencyCode": "USD", "issuer": denied, "limit": "100"},
+		Storage:   td.S,
+	})
+	expectPolicyDenied(t, resp, err)
+	resp, err = requestPayment(td, map[string]interface{}{
+		"source":      "denylistSource",
+		"destination": "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf",
+		"assetCode":   "USD",
+		"assetIssuer": denied,
+		"amount":      "1",
+	})
+	expectPolicyDenied(t, resp, err)
+
+	// A bulk import with an invalid entry imports nothing
+	importDenylist := func(d map[string]interface{}) *logical.Response {
+		resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "denylist/import",
+			Data:      d,
+			Storage:   td.S,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp = importDenylist(map[string]interface{}{"data": "address,reason,source\nrGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf,x,y\nnotAnAddress,x,y\n"})
+	if !resp.IsError() {
+		t.Fatalf("expected an import with an invalid address to be refused")
+	}
+	if entry, _ := td.B.(*backend).readDenylistEntry(context.Background(), td.S, "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf"); entry != nil {
+		t.Fatalf("expected nothing to be imported")
+	}
+
+	// Replacing the list drops the entries not in the import
+	resp = importDenylist(map[string]interface{}{
+		"format":  "json",
+		"data":    `[{"address": "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", "reason": "sanctioned", "source": "OFAC SDN"}]`,
+		"replace": true,
+	})
+	if resp.IsError() || resp.Data["added"] != 1 || resp.Data["removed"] != 1 {
+		t.Fatalf("unexpected import result: %v", resp)
+	}
+	createPayment(td, "denylistSource", "denylistDestination", "1", t)
+	resp, err = requestPayment(td, map[string]interface{}{
+		"source":      "denylistSource",
+		"destination": "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf",
+		"assetCode":   "native",
+		"amount":      "1",
+	})
+	expectPolicyDenied(t, resp, err)
+}
+
+func TestBackend_approvals(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "treasury", t)
+	createAccount(td, "approvalDestination", t)
+
+	resp := writeAccountPath(td, "treasury/approval_policy", map[string]interface{}{
+		"thresholds": map[string]interface{}{"XRP": "100"},
+	}, t)
+	if resp.IsError() || resp.Data["approvals"] != 2 || resp.Data["ttl"] != int64(86400) {
+		t.Fatalf("unexpected approval policy: %v", resp)
+	}
+
+	// Payments up to the threshold are signed right away
+	createPayment(td, "treasury", "approvalDestination", "100", t)
+
+	holdPayment := func(amount string) string {
+		resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "payments",
+			Data: map[string]interface{}{
+				"source":      "treasury",
+				"destination": "approvalDestination",
+				"assetCode":   "native",
+				"amount":      amount,
+			},
+			Storage:  td.S,
+			EntityID: "requester",
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to request payment: %v %v", err, resp)
+		}
+		if resp.Data["status"] != pendingStatusPending || resp.Data["signed_transaction"] != nil {
+			t.Fatalf("expected the payment to be held for approval: %v", resp.Data)
+		}
+		return resp.Data["pending_id"].(string)
+	}
+	pendingRequest := func(path string, entityID string) (*logical.Response, error) {
+		return td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   td.S,
+			EntityID:  entityID,
+		})
+	}
+	expectCode := func(code int, resp *logical.Response, err error) {
+		codedErr, ok := err.(logical.HTTPCodedError)
+		if !ok || codedErr.Code() != code {
+			t.Fatalf("expected a %d: %v %v", code, err, resp)
+		}
+	}
+
+	id := holdPayment("500")
+
+	// The requester cannot approve their own payment, and each approver counts once
+	resp, err := pendingRequest("pending/"+id+"/approve", "requester")
+	expectCode(403, resp, err)
+	resp, err = pendingRequest("pending/"+id+"/approve", "")
+	expectCode(403, resp, err)
+	resp, err = pendingRequest("pending/"+id+"/approve", "approver-1")
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to approve: %v %v", err, resp)
+	}
+	if resp.Data["status"] != pendingStatusPending || resp.Data["signed_transaction"] != nil {
+		t.Fatalf("expected the payment to wait for a second approval: %v", resp.Data)
+	}
+	resp, err = pendingRequest("pending/"+id+"/approve", "approver-1")
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected a second approval by the same entity to be refused: %v %v", err, resp)
+	}
+
+	// The second approval signs the payment as requested
+	resp, err = pendingRequest("pending/"+id+"/approve", "approver-2")
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to approve: %v %v", err, resp)
+	}
+	payment, ok := readSignedTransaction(t, resp.Data["signed_transaction"]).(*data.Payment)
+	if !ok || payment.Amount.String() != "500/XRP" {
+		t.Fatalf("unexpected signed transaction: %v", resp.Data)
+	}
+	approvedBy := resp.Data["approved_by"].([]string)
+	if len(approvedBy) != 2 || approvedBy[0] != "approver-1" || approvedBy[1] != "approver-2" {
+		t.Fatalf("unexpected approvers: %v", approvedBy)
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "pending/" + id,
+		Storage:   td.S,
+	})
+	if err != nil || resp == nil || resp.Data["status"] != pendingStatusSigned || resp.Data["transaction_hash"] != payment.Hash.String() {
+		t.Fatalf("unexpected pending transaction: %v %v", err, resp)
+	}
+	resp, err = pendingRequest("pending/"+id+"/approve", "approver-3")
+	expectCode(400, resp, err)
+
+	// A rejected payment can no longer be approved
+	id = holdPayment("200")
+	resp, err = pendingRequest("pending/"+id+"/reject", "requester")
+	if err != nil || resp.IsError() || resp.Data["status"] != pendingStatusRejected {
+		t.Fatalf("failed to reject: %v %v", err, resp)
+	}
+	resp, err = pendingRequest("pending/"+id+"/approve", "approver-1")
+	expectCode(400, resp, err)
+
+	// Nor can an expired one, which is removed by the periodic function
+	id = holdPayment("300")
+	b := td.B.(*backend)
+	pending, err := b.readPendingTransaction(context.Background(), td.S, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending.ExpiresAt = time.Now().Add(-time.Minute)
+	err = b.writePendingTransaction(context.Background(), td.S, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = pendingRequest("pending/"+id+"/approve", "approver-1")
+	expectCode(400, resp, err)
+	err = b.expirePendingTransactions(context.Background(), td.S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err = b.readPendingTransaction(context.Background(), td.S, id)
+	if err != nil || pending == nil || pending.Status != pendingStatusExpired {
+		t.Fatalf("expected the transaction to be kept as expired: %v %v", err, pending)
+	}
+
+	// Signed and rejected transactions are kept past their expiry as the record of their approvals
+	ids, err := td.S.List(context.Background(), pendingTxStoragePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		pending, err := b.readPendingTransaction(context.Background(), td.S, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending.ExpiresAt = time.Now().Add(-time.Minute)
+		err = b.writePendingTransaction(context.Background(), td.S, pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = b.expirePendingTransactions(context.Background(), td.S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]int{}
+	for _, id := range ids {
+		pending, _ := b.readPendingTransaction(context.Background(), td.S, id)
+		if pending != nil {
+			statuses[pending.Status]++
+		}
+	}
+	if statuses[pendingStatusSigned] != 1 || statuses[pendingStatusRejected] != 1 || statuses[pendingStatusExpired] != 1 {
+		t.Fatalf("expected every transaction to be kept: %v", statuses)
+	}
+}
+
+func TestBackend_approvalsHoldFundingAndSweeps(t *testing.T) {
+	td := setupTest(t)
+	createAccount(td, "treasury", t)
+	createAccount(td, "approvalDestination", t)
+	writeAccountPath(td, "treasury/approval_policy", map[string]interface{}{
+		"thresholds": map[string]interface{}{"XRP": "10"},
+	}, t)
+
+	approve := func(id string) (*logical.Response, error) {
+		var resp *logical.Response
+		var err error
+		for _, entityID := range []string{"approver-1", "approver-2"} {
+			resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "pending/" + id + "/approve",
+				Storage:   td.S,
+				EntityID:  entityID,
+			})
+			if err != nil || resp.IsError() {
+				break
+			}
+		}
+		return resp, err
+	}
+
+	// Funding a new account from the treasury is held like a payment, and paid to the new account once approved
+	resp := createAccountWithData(td, "heldFunding", map[string]interface{}{
+		"source_account_name": "treasury",
+		"xrp_balance":         "20",
+	}, t)
+	fundingID, ok := resp.Data["funding_pending_id"].(string)
+	if !ok || resp.Data["funding_signed_transaction"] != nil || resp.Data["funding_submitted"] != false {
+		t.Fatalf("expected the funding payment to be held for approval: %v", resp.Data)
+	}
+	resp, err := approve(fundingID)
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to approve the funding payment: %v %v", err, resp)
+	}
+	funding, ok := readSignedTransaction(t, resp.Data["signed_transaction"]).(*data.Payment)
+	if !ok || funding.Amount.String() != "20/XRP" || funding.Destination != ledgerAccount(td, "heldFunding", t) {
+		t.Fatalf("unexpected funding payment: %v", resp.Data)
+	}
+
+	// An approved payment is not signed once its destination has changed
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "payments",
+		Data: map[string]interface{}{
+			"source":      "treasury",
+			"destination": "approvalDestination",
+			"assetCode":   "native",
+			"amount":      "20",
+		},
+		Storage:  td.S,
+		EntityID: "requester",
+	})
+	if err != nil || resp.IsError() || resp.Data["pending_id"] == nil {
+		t.Fatalf("expected the payment to be held for approval: %v %v", err, resp)
+	}
+	updateAccount(td, "approvalDestination", map[string]interface{}{"replace_keys": true}, t)
+	resp, err = approve(resp.Data["pending_id"].(string))
+	if codedErr, ok := err.(logical.HTTPCodedError); !ok || codedErr.Code() != 409 {
+		t.Fatalf("expected a payment to a changed destination to be refused: %v %v", err, resp)
+	}
+
+	sweep := func(d map[string]interface{}) *logical.Response {
+		d["destination"] = "approvalDestination"
+		resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "accounts/treasury/delete",
+			Data:      d,
+			Storage:   td.S,
+			EntityID:  "requester",
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to request sweep: %v %v", err, resp)
+		}
+		if resp.Data["status"] != pendingStatusPending || resp.Data["kind"] != pendingKindAccountDelete {
+			t.Fatalf("expected the sweep to be held for approval: %v", resp.Data)
+		}
+		return resp
+	}
+
+	// Offline the swept amount is unknown, so the sweep is held whatever the threshold
+	resp = sweep(map[string]interface{}{"offline": true, "sequence": 1, "force": true})
+	if resp.Data["amount"] != "" {
+		t.Fatalf("expected the offline sweep to have no amount: %v", resp.Data)
+	}
+
+	// The sweep moves the remaining balance, above the threshold
+	resp = sweep(map[string]interface{}{})
+	if resp.Data["amount"] != "49.8 XRP" {
+		t.Fatalf("unexpected swept amount: %v", resp.Data)
+	}
+	resp, err = approve(resp.Data["pending_id"].(string))
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to approve the sweep: %v %v", err, resp)
+	}
+	accountDelete, ok := readSignedTransaction(t, resp.Data["signed_transaction"]).(*data.AccountDelete)
+	if !ok || accountDelete.Destination != ledgerAccount(td, "approvalDestination", t) {
+		t.Fatalf("unexpected sweep: %v", resp.Data)
 	}
-	t.Logf("Submitted transaction result : %s -- %s", response.EngineResult.String(), response.EngineResultMessage)
-	return response
 }
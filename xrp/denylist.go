@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/rubblelabs/ripple/data"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// denylistStoragePrefix holds one entry per denied classic address
+	denylistStoragePrefix = "denylist/"
+
+	denylistFormatCSV  = "csv"
+	denylistFormatJSON = "json"
+)
+
+// DenylistEntry is an address no account in the mount may send to
+type DenylistEntry struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+func denylistPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "denylist/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathListDenylist,
+			},
+		},
+		// Registered before denylist/<address>, which would also match it
+		&framework.Path{
+			Pattern:      "denylist/import",
+			HelpSynopsis: "Add many addresses to the mount-wide denylist at once.",
+			HelpDescription: "data holds either CSV rows of address,reason,source, with an optional header row, or a JSON " +
+				"array of objects with address, reason and source. Nothing is imported if any entry is invalid. " +
+				"With replace=true the imported entries replace the whole denylist.",
+			Fields: map[string]*framework.FieldSchema{
+				"format": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Format of data, csv or json",
+					Default:     denylistFormatCSV,
+				},
+				"data": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "The entries to import",
+				},
+				"replace": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Remove every address not in data from the denylist",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathImportDenylist,
+				logical.UpdateOperation: b.pathImportDenylist,
+			},
+		},
+		&framework.Path{
+			Pattern:      "denylist/" + framework.GenericNameRegex("address"),
+			HelpSynopsis: "Deny every account in the mount from sending to an address.",
+			HelpDescription: "The address can be a classic address or an X-address; entries are stored under the classic " +
+				"address, so X-addresses for the same account with any tag are denied as well.",
+			Fields: map[string]*framework.FieldSchema{
+				"address": &framework.FieldSchema{Type: framework.TypeString},
+				"reason": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Why the address is denied",
+				},
+				"source": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) The list the address comes from, e.g. OFAC SDN",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathWriteDenylistEntry,
+				logical.UpdateOperation: b.pathWriteDenylistEntry,
+				logical.ReadOperation:   b.pathReadDenylistEntry,
+				logical.DeleteOperation: b.pathDeleteDenylistEntry,
+			},
+		},
+	}
+}
+
+// Lists the denied addresses
+func (b *backend) pathListDenylist(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	addresses, err := req.Storage.List(ctx, denylistStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(addresses), nil
+}
+
+// Adds an address to the denylist, or updates its reason and source
+func (b *backend) pathWriteDenylistEntry(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := newDenylistEntry(d.Get("address").(string), d.Get("reason").(string), d.Get("source").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	err = b.writeDenylistEntry(ctx, req.Storage, entry)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("added %s to the denylist", entry.Address)
+	return denylistEntryResponse(entry), nil
+}
+
+// Returns a denylist entry
+func (b *backend) pathReadDenylistEntry(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := b.readDenylistEntry(ctx, req.Storage, normalizeAddress(d.Get("address").(string)))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return denylistEntryResponse(entry), nil
+}
+
+// Removes an address from the denylist
+func (b *backend) pathDeleteDenylistEntry(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	address := normalizeAddress(d.Get("address").(string))
+	err := req.Storage.Delete(ctx, denylistStoragePrefix+address)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("removed %s from the denylist", address)
+	return nil, nil
+}
+
+// Imports entries in bulk. Every entry is validated before any is written.
+func (b *backend) pathImportDenylist(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	raw := d.Get("data").(string)
+	if raw == "" {
+		return errMissingField("data"), nil
+	}
+
+	var entries []*DenylistEntry
+	var err error
+	switch d.Get("format").(string) {
+	case denylistFormatCSV:
+		entries, err = parseDenylistCSV(raw)
+	case denylistFormatJSON:
+		entries, err = parseDenylistJSON(raw)
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("format must be %s or %s", denylistFormatCSV, denylistFormatJSON)), nil
+	}
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	existing, err := req.Storage.List(ctx, denylistStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	existingAddresses := make(map[string]bool, len(existing))
+	for _, address := range existing {
+		existingAddresses[address] = true
+	}
+
+	added, updated := 0, 0
+	imported := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		err = b.writeDenylistEntry(ctx, req.Storage, entry)
+		if err != nil {
+			return nil, err
+		}
+		if existingAddresses[entry.Address] || imported[entry.Address] {
+			updated++
+		} else {
+			added++
+		}
+		imported[entry.Address] = true
+	}
+
+	removed := 0
+	if d.Get("replace").(bool) {
+		for _, address := range existing {
+			if imported[address] {
+				continue
+			}
+			err = req.Storage.Delete(ctx, denylistStoragePrefix+address)
+			if err != nil {
+				return nil, err
+			}
+			removed++
+		}
+	}
+
+	log.Printf("imported the denylist: %d added, %d updated, %d removed", added, updated, removed)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"added":   added,
+			"updated": updated,
+			"removed": removed,
+		},
+	}, nil
+}
+
+// checkDenylist refuses to sign a transaction involving an address on the denylist
+func (b *backend) checkDenylist(ctx context.Context, s logical.Storage, address string) error {
+	entry, err := b.readDenylistEntry(ctx, s, normalizeAddress(address))
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		log.Printf("refused to sign a transaction involving denied address %s (%s, %s)", entry.Address, entry.Source, entry.Reason)
+		return errPolicyDenied("%s is on the mount denylist", entry.Address)
+	}
+	return nil
+}
+
+func newDenylistEntry(address string, reason string, source string) (*DenylistEntry, error) {
+	address = strings.TrimSpace(address)
+	if isXAddress(address) {
+		decoded, err := decodeXAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-address %s: %s", address, err)
+		}
+		address = decoded.Account.String()
+	}
+	account, err := data.NewAccountFromAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	return &DenylistEntry{
+		Address: account.String(),
+		Reason:  strings.TrimSpace(reason),
+		Source:  strings.TrimSpace(source),
+		AddedAt: time.Now().UTC(),
+	}, nil
+}
+
+// parseDenylistCSV parses rows of address,reason,source. A first row starting with "address" is a header.
+func parseDenylistCSV(raw string) ([]*DenylistEntry, error) {
+	reader := csv.NewReader(strings.NewReader(raw))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var entries []*DenylistEntry
+	var invalid []string
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %s", err)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "address") {
+			continue
+		}
+		if len(record) > 3 {
+			invalid = append(invalid, fmt.Sprintf("line %d has more than 3 columns", line))
+			continue
+		}
+		for len(record) < 3 {
+			record = append(record, "")
+		}
+		entry, err := newDenylistEntry(record[0], record[1], record[2])
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("line %d: %s", line, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, invalidDenylistEntries(invalid)
+}
+
+// parseDenylistJSON parses an array of objects with address, reason and source
+func parseDenylistJSON(raw string) ([]*DenylistEntry, error) {
+	var records []struct {
+		Address string `json:"address"`
+		Reason  string `json:"reason"`
+		Source  string `json:"source"`
+	}
+	err := json.Unmarshal([]byte(raw), &records)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+
+	var entries []*DenylistEntry
+	var invalid []string
+	for i, record := range records {
+		entry, err := newDenylistEntry(record.Address, record.Reason, record.Source)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("entry %d: %s", i, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, invalidDenylistEntries(invalid)
+}
+
+func invalidDenylistEntries(invalid []string) error {
+	if len(invalid) == 0 {
+		return nil
+	}
+	return fmt.Errorf("nothing was imported, %d entries are invalid: %s", len(invalid), strings.Join(invalid, "; "))
+}
+
+func denylistEntryResponse(entry *DenylistEntry) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"address":  entry.Address,
+			"reason":   entry.Reason,
+			"source":   entry.Source,
+			"added_at": entry.AddedAt,
+		},
+	}
+}
+
+func (b *backend) readDenylistEntry(ctx context.Context, s logical.Storage, address string) (*DenylistEntry, error) {
+	entry, err := s.Get(ctx, denylistStoragePrefix+address)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	var denylistEntry DenylistEntry
+	err = entry.DecodeJSON(&denylistEntry)
+	if err != nil {
+		return nil, err
+	}
+	return &denylistEntry, nil
+}
+
+// writeDenylistEntry stores an entry, keeping the time an address was first added
+func (b *backend) writeDenylistEntry(ctx context.Context, s logical.Storage, denylistEntry *DenylistEntry) error {
+	existing, err := b.readDenylistEntry(ctx, s, denylistEntry.Address)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		denylistEntry.AddedAt = existing.AddedAt
+	}
+
+	entry, err := logical.StorageEntryJSON(denylistStoragePrefix+denylistEntry.Address, denylistEntry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"testing"
+)
+
+func TestDenylist_parseCSV(t *testing.T) {
+	entries, err := parseDenylistCSV("address,reason,source\n" +
+		"rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf, sanctioned, OFAC SDN\n" +
+		"T719a5UwUCnEs54UsxG9CJYYDhwmFCqkr7wxCcNcfZ6p5GZ\n" +
+		"\"r9cZA1mLK5R5Am25ArfXFmqgNwjZgnfk59\",\"fraud, reported twice\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected three entries: %v", entries)
+	}
+	if entries[0].Address != "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf" || entries[0].Reason != "sanctioned" || entries[0].Source != "OFAC SDN" {
+		t.Fatalf("unexpected first entry: %v", entries[0])
+	}
+	if entries[1].Address != "r9cZA1mLK5R5Am25ArfXFmqgNwjZgnfk59" {
+		t.Fatalf("expected the X-address to be stored as a classic address: %v", entries[1])
+	}
+	if entries[2].Reason != "fraud, reported twice" {
+		t.Fatalf("expected a quoted reason: %v", entries[2])
+	}
+
+	_, err = parseDenylistCSV("rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf,a,b,c\n")
+	if err == nil {
+		t.Fatalf("expected rows with extra columns to be refused")
+	}
+}
+
+func TestDenylist_parseJSON(t *testing.T) {
+	entries, err := parseDenylistJSON(`[{"address": "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", "reason": "sanctioned"}]`)
+	if err != nil || len(entries) != 1 || entries[0].Reason != "sanctioned" {
+		t.Fatalf("unexpected entries: %v %v", entries, err)
+	}
+
+	for _, invalid := range []string{`{"address": "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf"}`, `[{"address": "notAnAddress"}]`, `[{}]`} {
+		if _, err := parseDenylistJSON(invalid); err == nil {
+			t.Fatalf("expected %s to be refused", invalid)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rubblelabs/ripple/crypto"
+)
+
+// Seeds of Ed25519 keys are encoded with a 3 byte prefix, which makes them start with "sEd". The
+// one byte prefix of plain family seeds ("s...") says nothing about the key type.
+var ed25519SeedPrefix = []byte{0x01, 0xE1, 0x4B}
+
+const familySeedLength = 16
+
+// encodeFamilySeed encodes a 16 byte family seed the way rippled does for the given key type
+func encodeFamilySeed(keyType string, rawSeed []byte) (string, error) {
+	if keyType != keyTypeEd25519 {
+		seed, err := crypto.NewFamilySeed(rawSeed)
+		if err != nil {
+			return "", err
+		}
+		return seed.String(), nil
+	}
+	if len(rawSeed) != familySeedLength {
+		return "", fmt.Errorf("family seeds are %d bytes, got %d", familySeedLength, len(rawSeed))
+	}
+	payload := append(append([]byte{}, ed25519SeedPrefix...), rawSeed...)
+	return base58Encode(append(payload, doubleSha256(payload)[:4]...)), nil
+}
+
+// decodeFamilySeed decodes an encoded family seed. The returned key type is keyTypeEd25519 for
+// "sEd..." seeds and empty for plain family seeds, whose key type has to be known separately.
+func decodeFamilySeed(s string) ([]byte, string, error) {
+	raw, err := base58Decode(s)
+	if err == nil && len(raw) == len(ed25519SeedPrefix)+familySeedLength+4 && bytes.HasPrefix(raw, ed25519SeedPrefix) {
+		payload, checksum := raw[:len(raw)-4], raw[len(raw)-4:]
+		if !bytes.Equal(checksum, doubleSha256(payload)[:4]) {
+			return nil, "", fmt.Errorf("invalid seed checksum")
+		}
+		return payload[len(ed25519SeedPrefix):], keyTypeEd25519, nil
+	}
+
+	seed, err := crypto.NewRippleHashCheck(s, crypto.RIPPLE_FAMILY_SEED)
+	if err != nil {
+		return nil, "", err
+	}
+	return seed.Payload(), "", nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFamilySeed_ed25519(t *testing.T) {
+	// The Ed25519 seed of the ripple-address-codec examples
+	rawSeed, _ := hex.DecodeString("4C3A1D213FBDFB14C7C28D609469B341")
+	encoded, err := encodeFamilySeed(keyTypeEd25519, rawSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != "sEdTM1uX8pu2do5XvTnutH6HsouMaM2" {
+		t.Fatalf("unexpected seed %s", encoded)
+	}
+
+	decoded, keyType, err := decodeFamilySeed(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyType != keyTypeEd25519 || !strings.EqualFold(hex.EncodeToString(decoded), "4C3A1D213FBDFB14C7C28D609469B341") {
+		t.Fatalf("unexpected decoded seed %x of type %q", decoded, keyType)
+	}
+
+	if _, _, err := decodeFamilySeed("sEdTM1uX8pu2do5XvTnutH6HsouMaM3"); err == nil {
+		t.Fatalf("expected a bad checksum to be rejected")
+	}
+}
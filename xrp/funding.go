@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/shopspring/decimal"
+	"log"
+	"net/http"
+)
+
+const (
+	fundingModeNone    = "none"
+	fundingModeFaucet  = "faucet"
+	fundingModeAccount = "account"
+
+	defaultFaucetURL     = "https://faucet.altnet.rippletest.net/accounts"
+	defaultFundingAmount = "1000"
+	defaultBaseReserve   = "1"
+	defaultOwnerReserve  = "0.2"
+)
+
+var fundingModes = []string{fundingModeNone, fundingModeFaucet, fundingModeAccount}
+
+// prepareMountFunding builds and signs a payment of amount XRP to a newly created account, either
+// from a faucet-generated account or from the mount's funding account. Returns nil if the mount
+// does not fund new accounts. A payment that needs the approval of the funding account's operators
+// is not signed, and the pending transaction to hold it under once the new account is stored is
+// returned instead.
+func (b *backend) prepareMountFunding(ctx context.Context, req *logical.Request, config *Config, address string, amount string) (*data.Payment, *PendingTransaction, error) {
+	if config.FundingMode == fundingModeNone || config.FundingMode == "" {
+		return nil, nil, nil
+	}
+	if config.Offline {
+		return nil, nil, fmt.Errorf("cannot fund accounts on an offline mount, set funding_mode to '%s'", fundingModeNone)
+	}
+
+	var fundingAccount *Account
+	switch config.FundingMode {
+	case fundingModeFaucet:
+		faucetAddress, faucetSecret, err := b.generateFaucetAccount(config.FaucetURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		fundingAccount = &Account{
+			AccountId: faucetAddress,
+			Secret:    faucetSecret}
+	case fundingModeAccount:
+		account, err := b.readVaultAccount(ctx, req, "accounts/"+config.FundingAccount)
+		if err != nil {
+			return nil, nil, err
+		}
+		if account == nil {
+			return nil, nil, fmt.Errorf("funding account '%s' not found", config.FundingAccount)
+		}
+		fundingAccount = account
+	default:
+		return nil, nil, fmt.Errorf("unknown funding mode '%s'", config.FundingMode)
+	}
+
+	// The funding account's spend policy applies to funding payments like any other
+	fundingAmount, err := decimal.NewFromString(amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = b.enforceSpendPolicy(ctx, req.Storage, fundingAccount, address, nativeSpend(fundingAmount))
+	if err != nil {
+		return nil, nil, err
+	}
+	if fundingAccount.ApprovalPolicy.requiresApproval(nativeSpend(fundingAmount)) {
+		pending, err := newFundingPendingTransaction(req, config.FundingAccount, fundingAccount, address, fundingAmount, nil)
+		return nil, pending, err
+	}
+
+	// Send the XRP over to our target address
+	payment, err := createPaymentTransaction(fundingAccount.AccountId, address, amount, "native", "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signed, err := b.signLimitedPayment(ctx, req.Storage, config, fundingAccount, payment, nativeSpend(fundingAmount), nil)
+	return signed, nil, err
+}
+
+// prepareSourceFunding builds and signs a payment of amount XRP to a newly created account from
+// the named Vault account, enforcing the source account's spend policy and the base reserve. Like
+// mount funding, a payment that needs approval is returned as a pending transaction instead.
+func (b *backend) prepareSourceFunding(ctx context.Context, req *logical.Request, config *Config, sourceAccountName string, address string, amount decimal.Decimal, opts *txOptions) (*data.Payment, *PendingTransaction, error) {
+	baseReserve, err := decimal.NewFromString(config.BaseReserve)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amount.LessThan(baseReserve) {
+		return nil, nil, logical.CodedError(400, fmt.Sprintf("xrp_balance must be at least the base reserve of %s XRP", config.BaseReserve))
+	}
+
+	sourceAccount, err := b.readVaultAccount(ctx, req, "accounts/"+sourceAccountName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sourceAccount == nil {
+		return nil, nil, logical.CodedError(400, "source account not found")
+	}
+
+	err = b.enforceSpendPolicy(ctx, req.Storage, sourceAccount, address, nativeSpend(amount))
+	if err != nil {
+		return nil, nil, err
+	}
+	if sourceAccount.ApprovalPolicy.requiresApproval(nativeSpend(amount)) {
+		pending, err := newFundingPendingTransaction(req, sourceAccountName, sourceAccount, address, amount, req.Data)
+		return nil, pending, err
+	}
+
+	payment, err := createPaymentTransaction(sourceAccount.AccountId, address, amount.String(), "native", "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signed, err := b.signLimitedPayment(ctx, req.Storage, config, sourceAccount, payment, nativeSpend(amount), opts)
+	return signed, nil, err
+}
+
+// newFundingPendingTransaction prepares a funding payment for approval as the equivalent payments request,
+// keeping the signing options of the account creation request, if any
+func newFundingPendingTransaction(req *logical.Request, sourceAccountName string, sourceAccount *Account, address string, amount decimal.Decimal, options map[string]interface{}) (*PendingTransaction, error) {
+	request := map[string]interface{}{
+		"source":      sourceAccountName,
+		"destination": address,
+		"amount":      amount.String(),
+		"assetCode":   "native",
+	}
+	for field := range txOptionFields(map[string]*framework.FieldSchema{}) {
+		if value, ok := options[field]; ok {
+			request[field] = value
+		}
+	}
+	return newPendingTransaction(req, pendingKindPayment, request, sourceAccountName, address, nativeSpend(amount), sourceAccount.ApprovalPolicy)
+}
+
+// submitFunding submits a signed funding payment and checks that it was accepted
+func (b *backend) submitFunding(config *Config, payment *data.Payment) (*ledgerSubmitResult, error) {
+	submitResult, err := b.ledger(config).Submit(payment)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Submitted transaction result : %s -- %s", submitResult.EngineResult, submitResult.EngineResultMessage)
+
+	if !submitSucceeded(submitResult) {
+		return submitResult, fmt.Errorf("funding transaction failed: %s -- %s", submitResult.EngineResult, submitResult.EngineResultMessage)
+	}
+	return submitResult, nil
+}
+
+// submitSucceeded reports whether the transaction was applied or queued by the server it was submitted to
+func submitSucceeded(result *ledgerSubmitResult) bool {
+	return result.EngineResult == "tesSUCCESS" || result.EngineResult == "terQUEUED"
+}
+
+// generateFaucetAccount asks a test network faucet for a new funded account
+func generateFaucetAccount(faucetURL string) (string, string, error) {
+	resp, err := http.Post(faucetURL, "application/json", nil)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to POST to faucet endpoint")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("faucet endpoint returned HTTP %d", resp.StatusCode)
+	}
+
+	type Account struct {
+		Address        string
+		ClassicAddress string `json:"classicAddress"`
+		Secret         string
+	}
+
+	type Container struct {
+		Account Account
+		Seed    string
+		Balance json.Number
+	}
+
+	result := &Container{}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to decode faucet response")
+	}
+
+	faucetAddress := result.Account.Address
+	if faucetAddress == "" {
+		faucetAddress = result.Account.ClassicAddress
+	}
+	faucetSecret := result.Account.Secret
+	if faucetSecret == "" {
+		faucetSecret = result.Seed
+	}
+	if faucetAddress == "" || faucetSecret == "" {
+		return "", "", fmt.Errorf("faucet response did not include an account")
+	}
+
+	log.Print("Generated faucet account '" + faucetAddress + "'")
+
+	return faucetAddress, faucetSecret, nil
+}
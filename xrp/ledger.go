@@ -0,0 +1,436 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/rubblelabs/ripple/websockets"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errLedgerTimeout is returned when rippled does not answer in time, which usually means the connection is dead
+var errLedgerTimeout = errors.New("ledger request timed out")
+
+// errLedgerConnection is returned when the connection to rippled was closed or reset under a request
+var errLedgerConnection = errors.New("ledger connection lost")
+
+// ledgerClient is the subset of the rippled API used by the backend
+type ledgerClient interface {
+	AccountInfo(account data.Account) (*ledgerAccountInfo, error)
+	Submit(tx data.Transaction) (*ledgerSubmitResult, error)
+	Fee() (*ledgerFeeInfo, error)
+	Tx(hash data.Hash256) (*ledgerTxInfo, error)
+	ServerInfo() (*ledgerServerInfo, error)
+	Close()
+}
+
+// ledgerClientFactory connects to a single rippled endpoint using the mount configuration
+type ledgerClientFactory func(config *Config, endpoint string) (ledgerClient, error)
+
+type ledgerAccountInfo struct {
+	Sequence uint32
+	Balance  *data.Value
+}
+
+type ledgerSubmitResult struct {
+	EngineResult        string
+	EngineResultMessage string
+}
+
+type ledgerFeeInfo struct {
+	BaseFee       *data.Value
+	OpenLedgerFee *data.Value
+}
+
+type ledgerTxInfo struct {
+	Validated      bool
+	Result         string
+	LedgerSequence uint32
+}
+
+type ledgerServerInfo struct {
+	ServerState             string
+	ValidatedLedgerAge      time.Duration
+	ValidatedLedgerSequence uint32
+}
+
+// newTransportLedgerClient connects to the endpoint using the transport selected in the mount configuration
+func newTransportLedgerClient(config *Config, endpoint string) (ledgerClient, error) {
+	if config.Transport == transportJsonRpc {
+		return newJsonRpcLedgerClient(config, endpoint)
+	}
+	return newWebsocketLedgerClient(config, endpoint)
+}
+
+// websocketLedgerClient talks to rippled over its websocket API
+type websocketLedgerClient struct {
+	remote  *websockets.Remote
+	timeout time.Duration
+}
+
+// newWebsocketLedgerClient connects to the given rippled endpoint
+func newWebsocketLedgerClient(config *Config, endpoint string) (ledgerClient, error) {
+	var remote *websockets.Remote
+	err := withTimeout(config.ConnectTimeout, func() (err error) {
+		remote, err = websockets.NewRemote(endpoint)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &websocketLedgerClient{
+		remote:  remote,
+		timeout: config.RequestTimeout,
+	}, nil
+}
+
+func (c *websocketLedgerClient) AccountInfo(account data.Account) (*ledgerAccountInfo, error) {
+	var result *websockets.AccountInfoResult
+	err := c.call(func() (err error) {
+		result, err = c.remote.AccountInfo(account)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerAccountInfo{
+		Sequence: *result.AccountData.Sequence,
+		Balance:  result.AccountData.Balance,
+	}, nil
+}
+
+func (c *websocketLedgerClient) Submit(tx data.Transaction) (*ledgerSubmitResult, error) {
+	var result *websockets.SubmitResult
+	err := c.call(func() (err error) {
+		result, err = c.remote.Submit(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerSubmitResult{
+		EngineResult:        result.EngineResult.String(),
+		EngineResultMessage: result.EngineResultMessage,
+	}, nil
+}
+
+func (c *websocketLedgerClient) Fee() (*ledgerFeeInfo, error) {
+	var result *websockets.FeeResult
+	err := c.call(func() (err error) {
+		result, err = c.remote.Fee()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerFeeInfo{
+		BaseFee:       &result.Drops.BaseFee,
+		OpenLedgerFee: &result.Drops.OpenLedgerFee,
+	}, nil
+}
+
+func (c *websocketLedgerClient) Tx(hash data.Hash256) (*ledgerTxInfo, error) {
+	var result *websockets.TxResult
+	err := c.call(func() (err error) {
+		result, err = c.remote.Tx(hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerTxInfo{
+		Validated:      result.Validated,
+		Result:         result.MetaData.TransactionResult.String(),
+		LedgerSequence: result.LedgerSequence,
+	}, nil
+}
+
+func (c *websocketLedgerClient) ServerInfo() (info *ledgerServerInfo, err error) {
+	// Servers that have not yet validated a ledger omit validated_ledger entirely
+	defer Recover(&err)
+
+	var result *websockets.ServerInfoResult
+	err = c.call(func() (err error) {
+		result, err = c.remote.ServerInfo()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerServerInfo{
+		ServerState:             result.Info.ServerState,
+		ValidatedLedgerAge:      time.Duration(result.Info.ValidatedLedger.Age) * time.Second,
+		ValidatedLedgerSequence: result.Info.ValidatedLedger.Sequence,
+	}, nil
+}
+
+func (c *websocketLedgerClient) Close() {
+	c.remote.Close()
+}
+
+// call runs a request on the remote within the request timeout. A remote whose connection has dropped
+// panics when a request is queued on it, which is reported as a lost connection.
+func (c *websocketLedgerClient) call(fn func() error) error {
+	return withTimeout(c.timeout, func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Wrapf(errLedgerConnection, "%v", r)
+			}
+		}()
+		return fn()
+	})
+}
+
+// managedLedgerClient routes requests over the backend's shared connection, redialing
+// and retrying once if the connection has stopped responding
+type managedLedgerClient struct {
+	b      *backend
+	config *Config
+}
+
+// ledger returns a client that uses the backend's shared connection to the ledger
+func (b *backend) ledger(config *Config) ledgerClient {
+	return &managedLedgerClient{b: b, config: config}
+}
+
+func (c *managedLedgerClient) AccountInfo(account data.Account) (result *ledgerAccountInfo, err error) {
+	err = c.b.withLedgerClient(c.config, func(client ledgerClient) (err error) {
+		result, err = client.AccountInfo(account)
+		return err
+	})
+	return result, err
+}
+
+func (c *managedLedgerClient) Submit(tx data.Transaction) (result *ledgerSubmitResult, err error) {
+	err = c.b.withLedgerClient(c.config, func(client ledgerClient) (err error) {
+		result, err = client.Submit(tx)
+		return err
+	})
+	return result, err
+}
+
+func (c *managedLedgerClient) Fee() (result *ledgerFeeInfo, err error) {
+	err = c.b.withLedgerClient(c.config, func(client ledgerClient) (err error) {
+		result, err = client.Fee()
+		return err
+	})
+	return result, err
+}
+
+func (c *managedLedgerClient) Tx(hash data.Hash256) (result *ledgerTxInfo, err error) {
+	err = c.b.withLedgerClient(c.config, func(client ledgerClient) (err error) {
+		result, err = client.Tx(hash)
+		return err
+	})
+	return result, err
+}
+
+func (c *managedLedgerClient) ServerInfo() (result *ledgerServerInfo, err error) {
+	err = c.b.withLedgerClient(c.config, func(client ledgerClient) (err error) {
+		result, err = client.ServerInfo()
+		return err
+	})
+	return result, err
+}
+
+// Close is a no-op; the shared connection is closed by the backend
+func (c *managedLedgerClient) Close() {}
+
+// withLedgerClient runs fn against the shared connection, dialing it if needed. If the
+// request times out or the connection is lost the endpoint is marked unhealthy and fn is
+// retried once on the next healthy endpoint.
+func (b *backend) withLedgerClient(config *Config, fn func(client ledgerClient) error) error {
+	client, endpoint, err := b.sharedLedgerClient(config)
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !isConnectionError(err) {
+		return err
+	}
+
+	b.markEndpoint(endpoint, err)
+	b.resetLedgerClient(client)
+	client, _, err = b.sharedLedgerClient(config)
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+// sharedLedgerClient returns the open connection, dialing the highest priority healthy
+// endpoint if there is none or the configuration changed
+func (b *backend) sharedLedgerClient(config *Config) (ledgerClient, string, error) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	endpoints := strings.Join(config.Endpoints, ",")
+	if b.client != nil && b.clientEndpoints == endpoints {
+		return b.client, b.clientEndpoint, nil
+	}
+	if b.client != nil {
+		b.client.Close()
+		b.client = nil
+	}
+
+	var lastErr error
+	for _, endpoint := range b.endpointsByHealth(config) {
+		client, err := b.newLedgerClient(config, endpoint)
+		if err != nil {
+			Log(err, "unable to connect to "+endpoint)
+			b.markEndpoint(endpoint, err)
+			lastErr = err
+			continue
+		}
+		b.client = client
+		b.clientEndpoint = endpoint
+		b.clientEndpoints = endpoints
+		return client, endpoint, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no rippled endpoints configured")
+	}
+	return nil, "", lastErr
+}
+
+// resetLedgerClient closes the given connection if it is still the shared one
+func (b *backend) resetLedgerClient(client ledgerClient) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if client != nil && b.client != client {
+		return
+	}
+	if b.client != nil {
+		b.client.Close()
+		b.client = nil
+		b.clientEndpoint = ""
+	}
+}
+
+// invalidate drops the shared connection when the configuration changes on another node
+func (b *backend) invalidate(ctx context.Context, key string) {
+	if key == configStoragePath {
+		b.resetLedgerClient(nil)
+		b.resetEndpointHealth()
+	}
+}
+
+// cleanup closes the shared connection when the backend is unmounted
+func (b *backend) cleanup(ctx context.Context) {
+	b.resetLedgerClient(nil)
+}
+
+// txValidated returns an error unless the transaction has been validated on the ledger with tesSUCCESS
+func (b *backend) txValidated(config *Config, txHash string) error {
+	hash, err := parseHash256(txHash)
+	if err != nil {
+		return err
+	}
+	txInfo, err := b.ledger(config).Tx(*hash)
+	if err != nil {
+		return fmt.Errorf("transaction %s not found: %s", txHash, err)
+	}
+	if !txInfo.Validated || txInfo.Result != "tesSUCCESS" {
+		return fmt.Errorf("transaction %s has not been validated (%s)", txHash, txInfo.Result)
+	}
+	return nil
+}
+
+// txFailed reports whether a transaction is known to have failed for good: it was validated with a
+// result other than tesSUCCESS, or the validated ledger has passed its LastLedgerSequence without it.
+// A transaction that could still be validated has not failed. A zero lastLedgerSequence means the
+// transaction has none, so it only fails once validated.
+func (b *backend) txFailed(config *Config, txHash string, lastLedgerSequence uint32) (bool, error) {
+	hash, err := parseHash256(txHash)
+	if err != nil {
+		return false, err
+	}
+
+	// Read the validated ledger first, so a transaction validated in between is still found below
+	var validatedLedgerSequence uint32
+	if lastLedgerSequence != 0 {
+		serverInfo, err := b.ledger(config).ServerInfo()
+		if err != nil {
+			return false, err
+		}
+		validatedLedgerSequence = serverInfo.ValidatedLedgerSequence
+	}
+
+	txInfo, err := b.ledger(config).Tx(*hash)
+	if err != nil && !txNotFound(err) {
+		return false, err
+	}
+	if err == nil && txInfo.Validated {
+		return txInfo.Result != "tesSUCCESS", nil
+	}
+	return lastLedgerSequence != 0 && validatedLedgerSequence > lastLedgerSequence, nil
+}
+
+// txNotFound reports whether err is rippled's answer for a transaction it does not know
+func txNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "txnNotFound")
+}
+
+// accountNotFound reports whether err is rippled's answer for an account that does not exist
+func accountNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "actNotFound")
+}
+
+// isConnectionError reports whether err means the connection to rippled is unusable, as opposed to
+// an error returned by rippled itself, such as an unknown account
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	switch cause {
+	case errLedgerTimeout, errLedgerConnection, io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe,
+		syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE:
+		return true
+	}
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+	// The websocket library reports closed connections as plain errors
+	message := cause.Error()
+	return strings.Contains(message, "websocket: close") ||
+		strings.Contains(message, "use of closed network connection") ||
+		strings.Contains(message, "connection reset by peer") ||
+		strings.Contains(message, "broken pipe")
+}
+
+// withTimeout runs fn, giving up once the timeout has elapsed
+func withTimeout(timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.Wrapf(errLedgerTimeout, "no response after %s", timeout)
+	}
+}
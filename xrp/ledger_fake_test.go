@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/rubblelabs/ripple/crypto"
+	"github.com/rubblelabs/ripple/data"
+	"io"
+	"sync"
+	"time"
+)
+
+// fakeLedger is an in-process stand-in for rippled. It tracks account sequences and
+// native balances, verifies signatures and records submitted transactions.
+type fakeLedger struct {
+	sync.Mutex
+	accounts       map[data.Account]*fakeLedgerAccount
+	txs            map[data.Hash256]*ledgerTxInfo
+	ledgerSequence uint32
+
+	// serverState and validatedLedgerAge are reported by ServerInfo
+	serverState        string
+	validatedLedgerAge time.Duration
+
+	// holdSubmissions queues submitted transactions without ever applying them
+	holdSubmissions bool
+
+	// faucetKeyType is the type of the keys handed out by the faucet, secp256k1 unless set
+	faucetKeyType string
+
+	// onServerInfo, if set, is called before ServerInfo answers, so tests can make requests in the middle of
+	// a path that reads the server state
+	onServerInfo func()
+
+	// onAccountInfo, if set, is called before AccountInfo answers, like onServerInfo
+	onAccountInfo func()
+}
+
+type fakeLedgerAccount struct {
+	Sequence       uint32
+	Balance        *data.Value
+	RegularKey     *data.RegularKey
+	MasterDisabled bool
+}
+
+func newFakeLedger() *fakeLedger {
+	return &fakeLedger{
+		accounts:       make(map[data.Account]*fakeLedgerAccount),
+		txs:            make(map[data.Hash256]*ledgerTxInfo),
+		ledgerSequence: 1,
+		serverState:    "full",
+	}
+}
+
+// useFakeLedger points the backend at a new fakeLedger for both ledger access and faucet funding
+func useFakeLedger(b logical.Backend) *fakeLedger {
+	ledger := newFakeLedger()
+	b.(*backend).newLedgerClient = func(config *Config, endpoint string) (ledgerClient, error) {
+		return ledger, nil
+	}
+	b.(*backend).generateFaucetAccount = ledger.generateFaucetAccount
+	return ledger
+}
+
+// generateFaucetAccount creates a new account on the fake ledger holding 10,000 XRP
+func (f *fakeLedger) generateFaucetAccount(faucetURL string) (string, string, error) {
+	rawSeed := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, rawSeed); err != nil {
+		return "", "", err
+	}
+	var key crypto.Key
+	var keySequence *uint32
+	var secret string
+	if f.faucetKeyType == keyTypeEd25519 {
+		ed25519Key, err := crypto.NewEd25519Key(rawSeed)
+		if err != nil {
+			return "", "", err
+		}
+		key = ed25519Key
+		secret, err = encodeFamilySeed(keyTypeEd25519, rawSeed)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		seed, err := crypto.NewFamilySeed(rawSeed)
+		if err != nil {
+			return "", "", err
+		}
+		ecdsaKey, err := crypto.NewECDSAKey(seed.Payload())
+		if err != nil {
+			return "", "", err
+		}
+		key = ecdsaKey
+		keySequenceZero := uint32(0)
+		keySequence = &keySequenceZero
+		secret = seed.String()
+	}
+	accountId, err := crypto.AccountId(key, keySequence)
+	if err != nil {
+		return "", "", err
+	}
+	account, err := data.NewAccountFromAddress(accountId.String())
+	if err != nil {
+		return "", "", err
+	}
+	balance, err := data.NewNativeValue(10000 * 1000000)
+	if err != nil {
+		return "", "", err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.accounts[*account] = &fakeLedgerAccount{Sequence: 1, Balance: balance}
+
+	return accountId.String(), secret, nil
+}
+
+func (f *fakeLedger) AccountInfo(account data.Account) (*ledgerAccountInfo, error) {
+	if f.onAccountInfo != nil {
+		f.onAccountInfo()
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	ledgerAccount, ok := f.accounts[account]
+	if !ok {
+		return nil, fmt.Errorf("actNotFound")
+	}
+	return &ledgerAccountInfo{
+		Sequence: ledgerAccount.Sequence,
+		Balance:  ledgerAccount.Balance,
+	}, nil
+}
+
+func (f *fakeLedger) Submit(tx data.Transaction) (*ledgerSubmitResult, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	valid, err := data.CheckSignature(tx)
+	if err != nil || !valid {
+		return &ledgerSubmitResult{EngineResult: "temBAD_SIGNATURE", EngineResultMessage: "The signature is invalid."}, nil
+	}
+	if f.holdSubmissions {
+		return &ledgerSubmitResult{EngineResult: "terQUEUED", EngineResultMessage: "Held until the escalated fee drops."}, nil
+	}
+
+	base := tx.GetBase()
+	source, ok := f.accounts[base.Account]
+	if !ok {
+		return &ledgerSubmitResult{EngineResult: "terNO_ACCOUNT", EngineResultMessage: "The source account does not exist."}, nil
+	}
+	if base.Sequence < source.Sequence {
+		return &ledgerSubmitResult{EngineResult: "tefPAST_SEQ", EngineResultMessage: "This sequence number has already passed."}, nil
+	}
+	if base.Sequence > source.Sequence {
+		return &ledgerSubmitResult{EngineResult: "terPRE_SEQ", EngineResultMessage: "Missing/inapplicable prior transaction."}, nil
+	}
+
+	// The signer must be the enabled master key or the regular key of the account
+	var signer data.RegularKey
+	copy(signer[:], sha256RipeMD160(base.SigningPubKey[:]))
+	if signer == data.RegularKey(base.Account) {
+		if source.MasterDisabled {
+			return &ledgerSubmitResult{EngineResult: "tefMASTER_DISABLED", EngineResultMessage: "Master key is disabled."}, nil
+		}
+	} else if source.RegularKey == nil || *source.RegularKey != signer {
+		return &ledgerSubmitResult{EngineResult: "tefBAD_AUTH", EngineResultMessage: "Transaction's public key is not authorized."}, nil
+	}
+	if accountSet, ok := tx.(*data.AccountSet); ok && accountSet.SetFlag != nil && *accountSet.SetFlag == asfDisableMaster {
+		if source.RegularKey == nil {
+			return &ledgerSubmitResult{EngineResult: "tecNO_ALTERNATIVE_KEY", EngineResultMessage: "The operation would remove the ability to sign transactions with the account."}, nil
+		}
+		source.MasterDisabled = true
+	}
+	if setRegularKey, ok := tx.(*data.SetRegularKey); ok {
+		source.RegularKey = setRegularKey.RegularKey
+	}
+
+	debit := base.Fee
+	if payment, ok := tx.(*data.Payment); ok && payment.Amount.IsNative() {
+		total, err := debit.Add(*payment.Amount.Value)
+		if err != nil {
+			return nil, err
+		}
+		debit = *total
+
+		destination, ok := f.accounts[payment.Destination]
+		if !ok {
+			zero, _ := data.NewNativeValue(0)
+			destination = &fakeLedgerAccount{Sequence: 1, Balance: zero}
+			f.accounts[payment.Destination] = destination
+		}
+		credited, err := destination.Balance.Add(*payment.Amount.Value)
+		if err != nil {
+			return nil, err
+		}
+		destination.Balance = credited
+	}
+
+	remaining, err := source.Balance.Subtract(debit)
+	if err != nil {
+		return nil, err
+	}
+	source.Balance = remaining
+	source.Sequence++
+
+	// Deleting an account sends whatever is left over to the destination
+	if accountDelete, ok := tx.(*data.AccountDelete); ok {
+		destination, ok := f.accounts[accountDelete.Destination]
+		if !ok {
+			return &ledgerSubmitResult{EngineResult: "tecNO_DST", EngineResultMessage: "Destination does not exist."}, nil
+		}
+		credited, err := destination.Balance.Add(*source.Balance)
+		if err != nil {
+			return nil, err
+		}
+		destination.Balance = credited
+		delete(f.accounts, base.Account)
+	}
+
+	f.ledgerSequence++
+	f.txs[base.Hash] = &ledgerTxInfo{
+		Validated:      true,
+		Result:         "tesSUCCESS",
+		LedgerSequence: f.ledgerSequence,
+	}
+
+	return &ledgerSubmitResult{EngineResult: "tesSUCCESS", EngineResultMessage: "The transaction was applied."}, nil
+}
+
+func (f *fakeLedger) Fee() (*ledgerFeeInfo, error) {
+	fee, err := data.NewNativeValue(10)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerFeeInfo{BaseFee: fee, OpenLedgerFee: fee}, nil
+}
+
+func (f *fakeLedger) ServerInfo() (*ledgerServerInfo, error) {
+	if f.onServerInfo != nil {
+		f.onServerInfo()
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return &ledgerServerInfo{
+		ServerState:             f.serverState,
+		ValidatedLedgerAge:      f.validatedLedgerAge,
+		ValidatedLedgerSequence: f.ledgerSequence,
+	}, nil
+}
+
+func (f *fakeLedger) Close() {}
+
+func (f *fakeLedger) Tx(hash data.Hash256) (*ledgerTxInfo, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	tx, ok := f.txs[hash]
+	if !ok {
+		return nil, fmt.Errorf("txnNotFound")
+	}
+	return tx, nil
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"log"
+	"time"
+)
+
+// endpointHealth is the outcome of the most recent health check of a rippled endpoint
+type endpointHealth struct {
+	Healthy            bool
+	LastChecked        time.Time
+	ServerState        string
+	ValidatedLedgerAge time.Duration
+	Error              string
+}
+
+// Server states in which rippled is in sync with the network
+var syncedServerStates = []string{"full", "validating", "proposing"}
+
+func healthPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "health",
+			HelpSynopsis: "Show the health of the configured rippled endpoints",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathReadHealth,
+			},
+		},
+	}
+}
+
+// Returns the result of the last health check for each configured endpoint
+func (b *backend) pathReadHealth(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	b.clientLock.Lock()
+	activeEndpoint := b.clientEndpoint
+	b.clientLock.Unlock()
+
+	b.healthLock.RLock()
+	defer b.healthLock.RUnlock()
+
+	endpoints := make([]map[string]interface{}, 0, len(config.Endpoints))
+	for priority, endpoint := range config.Endpoints {
+		status := map[string]interface{}{
+			"endpoint": endpoint,
+			"priority": priority,
+			"active":   endpoint == activeEndpoint,
+		}
+		if health, ok := b.health[endpoint]; ok {
+			status["healthy"] = health.Healthy
+			status["last_checked"] = health.LastChecked.Format(time.RFC3339)
+			status["server_state"] = health.ServerState
+			status["validated_ledger_age"] = int64(health.ValidatedLedgerAge / time.Second)
+			status["error"] = health.Error
+		}
+		endpoints = append(endpoints, status)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"endpoints": endpoints,
+		},
+	}, nil
+}
+
+// periodicFunc is invoked by Vault about once a minute. It removes expired pending transactions, checks the
+// endpoints when the check interval has elapsed and rotates the regular keys that are due.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	err := b.expirePendingTransactions(ctx, req.Storage)
+	if err != nil {
+		log.Printf("failed to expire pending transactions: %s", err)
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if config.Offline {
+		return nil
+	}
+
+	b.healthLock.RLock()
+	due := time.Since(b.lastHealthCheck) >= config.HealthCheckInterval
+	b.healthLock.RUnlock()
+	if due {
+		b.checkEndpoints(config)
+	}
+
+	return b.rotateRegularKeys(ctx, req, config)
+}
+
+// checkEndpoints queries server_info on every endpoint and switches the shared connection
+// over if its endpoint is unhealthy or a higher priority endpoint has recovered
+func (b *backend) checkEndpoints(config *Config) {
+	results := make(map[string]*endpointHealth, len(config.Endpoints))
+	for _, endpoint := range config.Endpoints {
+		results[endpoint] = b.checkEndpoint(config, endpoint)
+	}
+
+	b.healthLock.Lock()
+	b.health = results
+	b.lastHealthCheck = time.Now()
+	b.healthLock.Unlock()
+
+	preferred := ""
+	if endpoints := b.endpointsByHealth(config); len(endpoints) > 0 {
+		preferred = endpoints[0]
+	}
+
+	b.clientLock.Lock()
+	switchEndpoint := b.client != nil && b.clientEndpoint != preferred
+	b.clientLock.Unlock()
+	if switchEndpoint {
+		log.Printf("switching rippled endpoint to %s", preferred)
+		b.resetLedgerClient(nil)
+	}
+}
+
+// checkEndpoint connects to a single endpoint and evaluates its server_info
+func (b *backend) checkEndpoint(config *Config, endpoint string) *endpointHealth {
+	health := &endpointHealth{
+		LastChecked: time.Now(),
+	}
+
+	client, err := b.newLedgerClient(config, endpoint)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	defer client.Close()
+
+	info, err := client.ServerInfo()
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.ServerState = info.ServerState
+	health.ValidatedLedgerAge = info.ValidatedLedgerAge
+
+	switch {
+	case !contains(syncedServerStates, info.ServerState):
+		health.Error = fmt.Sprintf("server is not synced (%s)", info.ServerState)
+	case info.ValidatedLedgerAge > config.MaxLedgerAge:
+		health.Error = fmt.Sprintf("validated ledger is %s old", info.ValidatedLedgerAge)
+	default:
+		health.Healthy = true
+	}
+	return health
+}
+
+// endpointsByHealth returns the configured endpoints in priority order, with endpoints
+// known to be unhealthy moved to the end as a last resort
+func (b *backend) endpointsByHealth(config *Config) []string {
+	b.healthLock.RLock()
+	defer b.healthLock.RUnlock()
+
+	var healthy, unhealthy []string
+	for _, endpoint := range config.Endpoints {
+		if health, ok := b.health[endpoint]; ok && !health.Healthy {
+			unhealthy = append(unhealthy, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// markEndpoint records that a request to the endpoint failed
+func (b *backend) markEndpoint(endpoint string, err error) {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+
+	if b.health == nil {
+		b.health = make(map[string]*endpointHealth)
+	}
+	b.health[endpoint] = &endpointHealth{
+		LastChecked: time.Now(),
+		Error:       err.Error(),
+	}
+}
+
+// resetEndpointHealth forgets all health check results
+func (b *backend) resetEndpointHealth() {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+
+	b.health = nil
+	b.lastHealthCheck = time.Time{}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rubblelabs/ripple/data"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// jsonRpcLedgerClient talks to rippled over its JSON-RPC API
+type jsonRpcLedgerClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+type jsonRpcRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type jsonRpcError struct {
+	Status       string `json:"status"`
+	Error        string `json:"error"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// newJsonRpcLedgerClient creates a client for the given rippled JSON-RPC endpoint. Requests
+// go through config.ProxyURL if set, otherwise through the proxy from the environment.
+func newJsonRpcLedgerClient(config *Config, endpoint string) (ledgerClient, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy_url")
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &jsonRpcLedgerClient{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: config.RequestTimeout,
+			Transport: &http.Transport{
+				Proxy: proxy,
+				DialContext: (&net.Dialer{
+					Timeout: config.ConnectTimeout,
+				}).DialContext,
+				TLSHandshakeTimeout: config.ConnectTimeout,
+			},
+		},
+	}, nil
+}
+
+// call invokes a JSON-RPC method and decodes its result into result
+func (c *jsonRpcLedgerClient) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(&jsonRpcRequest{
+		Method: method,
+		Params: []interface{}{params},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Post(c.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return errors.Wrap(errLedgerTimeout, err.Error())
+		}
+		return errors.Wrap(errLedgerConnection, err.Error())
+	}
+	defer resp.Body.Close()
+
+	// A node that is down behind a load balancer or proxy answers with a server error
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Wrapf(errLedgerConnection, "%s returned HTTP %d", method, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", method, resp.StatusCode)
+	}
+
+	var envelope struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&envelope)
+	if err != nil {
+		return errors.Wrapf(err, "unable to decode %s response", method)
+	}
+
+	var status jsonRpcError
+	err = json.Unmarshal(envelope.Result, &status)
+	if err != nil {
+		return errors.Wrapf(err, "unable to decode %s response", method)
+	}
+	if status.Status == "error" || status.Error != "" {
+		if status.ErrorMessage != "" {
+			return fmt.Errorf("%s: %s", status.Error, status.ErrorMessage)
+		}
+		return fmt.Errorf("%s", status.Error)
+	}
+
+	return json.Unmarshal(envelope.Result, result)
+}
+
+func (c *jsonRpcLedgerClient) AccountInfo(account data.Account) (*ledgerAccountInfo, error) {
+	var result struct {
+		AccountData struct {
+			Sequence uint32 `json:"Sequence"`
+			Balance  string `json:"Balance"`
+		} `json:"account_data"`
+	}
+	err := c.call("account_info", map[string]interface{}{
+		"account":      account.String(),
+		"ledger_index": "current",
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := parseDrops(result.AccountData.Balance)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerAccountInfo{
+		Sequence: result.AccountData.Sequence,
+		Balance:  balance,
+	}, nil
+}
+
+func (c *jsonRpcLedgerClient) Submit(tx data.Transaction) (*ledgerSubmitResult, error) {
+	_, txRaw, err := data.Raw(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		EngineResult        string `json:"engine_result"`
+		EngineResultMessage string `json:"engine_result_message"`
+	}
+	err = c.call("submit", map[string]interface{}{
+		"tx_blob": fmt.Sprintf("%X", txRaw),
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerSubmitResult{
+		EngineResult:        result.EngineResult,
+		EngineResultMessage: result.EngineResultMessage,
+	}, nil
+}
+
+func (c *jsonRpcLedgerClient) Fee() (*ledgerFeeInfo, error) {
+	var result struct {
+		Drops struct {
+			BaseFee       string `json:"base_fee"`
+			OpenLedgerFee string `json:"open_ledger_fee"`
+		} `json:"drops"`
+	}
+	err := c.call("fee", map[string]interface{}{}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	baseFee, err := parseDrops(result.Drops.BaseFee)
+	if err != nil {
+		return nil, err
+	}
+	openLedgerFee, err := parseDrops(result.Drops.OpenLedgerFee)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerFeeInfo{
+		BaseFee:       baseFee,
+		OpenLedgerFee: openLedgerFee,
+	}, nil
+}
+
+func (c *jsonRpcLedgerClient) Tx(hash data.Hash256) (*ledgerTxInfo, error) {
+	var result struct {
+		Validated   bool   `json:"validated"`
+		LedgerIndex uint32 `json:"ledger_index"`
+		Meta        struct {
+			TransactionResult string `json:"TransactionResult"`
+		} `json:"meta"`
+	}
+	err := c.call("tx", map[string]interface{}{
+		"transaction": hash.String(),
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerTxInfo{
+		Validated:      result.Validated,
+		Result:         result.Meta.TransactionResult,
+		LedgerSequence: result.LedgerIndex,
+	}, nil
+}
+
+func (c *jsonRpcLedgerClient) ServerInfo() (*ledgerServerInfo, error) {
+	var result struct {
+		Info struct {
+			ServerState     string `json:"server_state"`
+			ValidatedLedger struct {
+				Age uint32 `json:"age"`
+				Seq uint32 `json:"seq"`
+			} `json:"validated_ledger"`
+		} `json:"info"`
+	}
+	err := c.call("server_info", map[string]interface{}{}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerServerInfo{
+		ServerState:             result.Info.ServerState,
+		ValidatedLedgerAge:      time.Duration(result.Info.ValidatedLedger.Age) * time.Second,
+		ValidatedLedgerSequence: result.Info.ValidatedLedger.Seq,
+	}, nil
+}
+
+// Close releases any idle connections
+func (c *jsonRpcLedgerClient) Close() {
+	if transport, ok := c.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// parseDrops converts a string amount of drops into a native value
+func parseDrops(drops string) (*data.Value, error) {
+	amount, err := strconv.ParseInt(drops, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid drops amount '%s'", drops)
+	}
+	return data.NewNativeValue(amount)
+}
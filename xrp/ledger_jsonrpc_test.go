@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rubblelabs/ripple/data"
+)
+
+func TestJsonRpcLedgerClient(t *testing.T) {
+	responses := map[string]string{
+		"account_info": `{"result":{"account_data":{"Account":"rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh","Balance":"25000000","Sequence":42},"status":"success"}}`,
+		"submit":       `{"result":{"engine_result":"tesSUCCESS","engine_result_message":"The transaction was applied.","status":"success"}}`,
+		"fee":          `{"result":{"drops":{"base_fee":"10","open_ledger_fee":"12"},"status":"success"}}`,
+		"tx":           `{"result":{"validated":true,"ledger_index":1234,"meta":{"TransactionResult":"tesSUCCESS"},"status":"success"}}`,
+		"server_info":  `{"result":{"info":{"server_state":"full","validated_ledger":{"age":3,"seq":1240}},"status":"success"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request jsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+		if response, ok := responses[request.Method]; ok {
+			w.Write([]byte(response))
+			return
+		}
+		w.Write([]byte(`{"result":{"error":"unknownCmd","error_message":"Unknown method.","status":"error"}}`))
+	}))
+	defer server.Close()
+
+	client, err := newJsonRpcLedgerClient(defaultConfig(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	account, err := data.NewAccountFromAddress("rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountInfo, err := client.AccountInfo(*account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedBalance, _ := data.NewNativeValue(25000000)
+	if accountInfo.Sequence != 42 || accountInfo.Balance.String() != expectedBalance.String() {
+		t.Fatalf("unexpected account info: %+v", accountInfo)
+	}
+
+	fee, err := client.Fee()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFee, _ := data.NewNativeValue(12)
+	if fee.OpenLedgerFee.String() != expectedFee.String() {
+		t.Fatalf("unexpected open ledger fee: %s", fee.OpenLedgerFee.String())
+	}
+
+	tx, err := client.Tx(data.Hash256{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tx.Validated || tx.Result != "tesSUCCESS" || tx.LedgerSequence != 1234 {
+		t.Fatalf("unexpected tx info: %+v", tx)
+	}
+
+	info, err := client.ServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ServerState != "full" || info.ValidatedLedgerAge.Seconds() != 3 || info.ValidatedLedgerSequence != 1240 {
+		t.Fatalf("unexpected server info: %+v", info)
+	}
+
+	var result struct{}
+	err = client.(*jsonRpcLedgerClient).call("ledger_closed", map[string]interface{}{}, &result)
+	if err == nil || !strings.Contains(err.Error(), "unknownCmd") {
+		t.Fatalf("expected the rippled error to be returned, got %v", err)
+	}
+}
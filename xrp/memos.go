@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"strings"
+)
+
+const (
+	// rippled rejects transactions whose serialized Memos field is larger than this
+	maxMemosSize = 1024
+
+	memoEncodingText = "text"
+	memoEncodingHex  = "hex"
+
+	// MemoType and MemoFormat may only contain characters allowed in URLs
+	memoUrlCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~:/?#[]@!$&'()*+,;=%"
+)
+
+// readMemos builds the memos of a transaction from the 'memo' shorthand and the 'memos' list. Each
+// entry of the list has a type, format and data, given as text unless its encoding is 'hex'.
+func readMemos(memo string, memosRaw []interface{}) (data.Memos, error) {
+	var memos data.Memos
+	if memo != "" {
+		memos = append(memos, newMemo(nil, nil, []byte(memo)))
+	}
+
+	for i, entryRaw := range memosRaw {
+		var entry map[string]interface{}
+		switch value := entryRaw.(type) {
+		case map[string]interface{}:
+			entry = value
+		case string:
+			// Entries passed on the command line arrive as JSON strings
+			err := json.Unmarshal([]byte(value), &entry)
+			if err != nil {
+				return nil, fmt.Errorf("memos[%d] is not a JSON object", i)
+			}
+		default:
+			return nil, fmt.Errorf("memos[%d] is not an object", i)
+		}
+
+		memo, err := readMemo(entry)
+		if err != nil {
+			return nil, fmt.Errorf("memos[%d] %s", i, err)
+		}
+		memos = append(memos, memo)
+	}
+
+	if size := memosSize(memos); size > maxMemosSize {
+		return nil, fmt.Errorf("memos are %d bytes, larger than the limit of %d bytes", size, maxMemosSize)
+	}
+	return memos, nil
+}
+
+func readMemo(entry map[string]interface{}) (data.Memo, error) {
+	fields := map[string]string{}
+	for key, value := range entry {
+		switch key {
+		case "type", "format", "data", "encoding":
+		default:
+			return data.Memo{}, fmt.Errorf("has unknown field '%s'", key)
+		}
+		s, ok := value.(string)
+		if !ok {
+			return data.Memo{}, fmt.Errorf("%s must be a string", key)
+		}
+		fields[key] = s
+	}
+
+	decode := func(s string) ([]byte, error) { return []byte(s), nil }
+	switch fields["encoding"] {
+	case "", memoEncodingText:
+	case memoEncodingHex:
+		decode = hex.DecodeString
+	default:
+		return data.Memo{}, fmt.Errorf("encoding must be '%s' or '%s'", memoEncodingText, memoEncodingHex)
+	}
+
+	var decoded [3][]byte
+	for i, key := range []string{"type", "format", "data"} {
+		value, err := decode(fields[key])
+		if err != nil {
+			return data.Memo{}, fmt.Errorf("%s is not valid hex", key)
+		}
+		decoded[i] = value
+	}
+	memoType, memoFormat, memoData := decoded[0], decoded[1], decoded[2]
+
+	if len(memoType) == 0 && len(memoFormat) == 0 && len(memoData) == 0 {
+		return data.Memo{}, fmt.Errorf("needs a type, format or data")
+	}
+	if !urlCharacters(memoType) {
+		return data.Memo{}, fmt.Errorf("type may only contain characters allowed in URLs")
+	}
+	if !urlCharacters(memoFormat) {
+		return data.Memo{}, fmt.Errorf("format may only contain characters allowed in URLs")
+	}
+	return newMemo(memoType, memoFormat, memoData), nil
+}
+
+func newMemo(memoType []byte, memoFormat []byte, memoData []byte) data.Memo {
+	var memo data.Memo
+	memo.Memo.MemoType = data.VariableLength(memoType)
+	memo.Memo.MemoFormat = data.VariableLength(memoFormat)
+	memo.Memo.MemoData = data.VariableLength(memoData)
+	return memo
+}
+
+func urlCharacters(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 || strings.IndexByte(memoUrlCharacters, c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// memosSize returns the serialized size of the Memos field: an array of Memo objects, each holding
+// up to three variable length fields with a one byte field header and a length prefix
+func memosSize(memos data.Memos) int {
+	if len(memos) == 0 {
+		return 0
+	}
+	size := 2
+	for _, memo := range memos {
+		size += 2
+		for _, field := range [][]byte{memo.Memo.MemoType, memo.Memo.MemoFormat, memo.Memo.MemoData} {
+			if len(field) > 0 {
+				size += 1 + lengthPrefixSize(len(field)) + len(field)
+			}
+		}
+	}
+	return size
+}
+
+func lengthPrefixSize(n int) int {
+	switch {
+	case n <= 192:
+		return 1
+	case n <= 12480:
+		return 2
+	default:
+		return 3
+	}
+}
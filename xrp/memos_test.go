@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemos_invalid(t *testing.T) {
+	tests := map[string]interface{}{
+		"empty":            map[string]interface{}{},
+		"unknown field":    map[string]interface{}{"data": "x", "text": "x"},
+		"not a string":     map[string]interface{}{"data": 1},
+		"bad encoding":     map[string]interface{}{"data": "x", "encoding": "base64"},
+		"bad hex":          map[string]interface{}{"data": "xyz", "encoding": "hex"},
+		"type not url":     map[string]interface{}{"type": "an invoice", "data": "x"},
+		"format not url":   map[string]interface{}{"format": "text/plain; charset=utf-8", "data": "x"},
+		"not an object":    []interface{}{"x"},
+		"not JSON":         "{data",
+		"too large":        map[string]interface{}{"data": strings.Repeat("x", maxMemosSize)},
+		"too large as hex": map[string]interface{}{"data": strings.Repeat("AB", maxMemosSize), "encoding": "hex"},
+	}
+	for name, memo := range tests {
+		if _, err := readMemos("", []interface{}{memo}); err == nil {
+			t.Fatalf("expected the %s memo to be refused", name)
+		}
+	}
+}
+
+func TestMemos_sizeLimit(t *testing.T) {
+	// One memo with only data has 2 bytes for the array, 2 for the object and 3 for the field header and length
+	largest := strings.Repeat("x", maxMemosSize-7)
+	if _, err := readMemos(largest, nil); err != nil {
+		t.Fatalf("expected a memo of exactly the limit to be accepted: %v", err)
+	}
+	if _, err := readMemos(largest+"x", nil); err == nil {
+		t.Fatalf("expected a memo over the limit to be refused")
+	}
+
+	// The limit applies to all memos together
+	half := map[string]interface{}{"data": strings.Repeat("x", maxMemosSize/2)}
+	if _, err := readMemos("", []interface{}{half, half}); err == nil {
+		t.Fatalf("expected memos over the limit together to be refused")
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+const mountKeyStoragePath = "mount_key"
+
+// mountKeyring holds the versions of the mount-level key that encrypts accounts and wallets at rest.
+// Older versions are kept until every entry has been re-encrypted with the current one.
+type mountKeyring struct {
+	CurrentVersion int            `json:"current_version"`
+	Keys           map[int][]byte `json:"keys"`
+	RotatedAt      time.Time      `json:"rotated_at"`
+}
+
+// envelope is stored in place of a record once a mount key exists
+type envelope struct {
+	KeyVersion int    `json:"envelope_key_version"`
+	Ciphertext []byte `json:"envelope_ciphertext"`
+}
+
+func mountKeyPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "config/mount_key",
+			HelpSynopsis: "Show the status of the mount key encrypting account secrets.",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathReadMountKey,
+			},
+		},
+		&framework.Path{
+			Pattern:      "config/mount_key/rotate",
+			HelpSynopsis: "Create or rotate the mount key encrypting account secrets.",
+			HelpDescription: "The first call enables envelope encryption of accounts and wallets. Later calls add a new key " +
+				"version used for all new writes. With rewrap=true every entry is re-encrypted with the new version " +
+				"and the old versions are discarded.",
+			Fields: map[string]*framework.FieldSchema{
+				"rewrap": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Re-encrypt all accounts and wallets with the new key version.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathRotateMountKey,
+				logical.UpdateOperation: b.pathRotateMountKey,
+			},
+		},
+	}
+}
+
+// Returns whether envelope encryption is enabled and which key versions exist
+func (b *backend) pathReadMountKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	keyring, err := b.readMountKeyring(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if keyring == nil {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"enabled": false,
+			},
+		}, nil
+	}
+	return mountKeyResponse(keyring), nil
+}
+
+// Adds a new mount key version, optionally re-encrypting every entry with it
+func (b *backend) pathRotateMountKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.mountKeyLock.Lock()
+	defer b.mountKeyLock.Unlock()
+
+	keyring, err := b.readMountKeyring(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if keyring == nil {
+		keyring = &mountKeyring{Keys: make(map[int][]byte)}
+	}
+
+	key := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	keyring.CurrentVersion++
+	keyring.Keys[keyring.CurrentVersion] = key
+	keyring.RotatedAt = time.Now().UTC()
+
+	err = b.writeMountKeyring(ctx, req.Storage, keyring)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("mount key rotated to version %d", keyring.CurrentVersion)
+
+	if d.Get("rewrap").(bool) {
+		rewrapped, err := b.rewrapEntries(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nothing is encrypted with the older versions any more
+		for version := range keyring.Keys {
+			if version != keyring.CurrentVersion {
+				delete(keyring.Keys, version)
+			}
+		}
+		err = b.writeMountKeyring(ctx, req.Storage, keyring)
+		if err != nil {
+			return nil, err
+		}
+
+		response := mountKeyResponse(keyring)
+		response.Data["rewrapped"] = rewrapped
+		return response, nil
+	}
+
+	return mountKeyResponse(keyring), nil
+}
+
+// rewrapEntries re-encrypts every account and wallet with the current mount key version. No other entry
+// is written until it is done, so no change made in between is overwritten, and every write that started
+// before the mount key was rotated has finished and is rewrapped.
+func (b *backend) rewrapEntries(ctx context.Context, s logical.Storage) (int, error) {
+	b.storageLock.Lock()
+	defer b.storageLock.Unlock()
+
+	rewrapped := 0
+	for _, prefix := range []string{"accounts/", walletStoragePrefix} {
+		names, err := s.List(ctx, prefix)
+		if err != nil {
+			return rewrapped, err
+		}
+		for _, name := range names {
+			var record json.RawMessage
+			found, err := b.getEncrypted(ctx, s, prefix+name, &record)
+			if err != nil {
+				return rewrapped, err
+			}
+			if !found {
+				continue
+			}
+			err = b.putEncryptedLocked(ctx, s, prefix+name, record)
+			if err != nil {
+				return rewrapped, err
+			}
+			rewrapped++
+		}
+	}
+	return rewrapped, nil
+}
+
+func mountKeyResponse(keyring *mountKeyring) *logical.Response {
+	versions := make([]int, 0, len(keyring.Keys))
+	for version := range keyring.Keys {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"enabled":         true,
+			"current_version": keyring.CurrentVersion,
+			"versions":        versions,
+			"rotated_at":      keyring.RotatedAt,
+		},
+	}
+}
+
+// putEncrypted stores v as JSON, encrypted with the current mount key if there is one. The storage
+// path is bound to the ciphertext so entries cannot be swapped between paths.
+func (b *backend) putEncrypted(ctx context.Context, s logical.Storage, path string, v interface{}) error {
+	b.storageLock.RLock()
+	defer b.storageLock.RUnlock()
+	return b.putEncryptedLocked(ctx, s, path, v)
+}
+
+// putEncryptedLocked is putEncrypted for callers that already hold storageLock
+func (b *backend) putEncryptedLocked(ctx context.Context, s logical.Storage, path string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := b.readMountKeyring(ctx, s)
+	if err != nil {
+		return err
+	}
+	if keyring != nil {
+		aead, err := newAEAD(keyring.Keys[keyring.CurrentVersion])
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return err
+		}
+		value, err = json.Marshal(&envelope{
+			KeyVersion: keyring.CurrentVersion,
+			Ciphertext: aead.Seal(nonce, nonce, value, []byte(path)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Put(ctx, &logical.StorageEntry{Key: path, Value: value})
+}
+
+// getEncrypted decodes the JSON stored at path into v, decrypting it first if it was written with a mount key.
+// Entries written before envelope encryption was enabled are read as they are.
+func (b *backend) getEncrypted(ctx context.Context, s logical.Storage, path string, v interface{}) (bool, error) {
+	entry, err := s.Get(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return false, nil
+	}
+
+	value := entry.Value
+	var sealed envelope
+	if err := json.Unmarshal(value, &sealed); err == nil && sealed.KeyVersion != 0 {
+		keyring, err := b.readMountKeyring(ctx, s)
+		if err != nil {
+			return false, err
+		}
+		if keyring == nil || keyring.Keys[sealed.KeyVersion] == nil {
+			return false, fmt.Errorf("mount key version %d for %s not found", sealed.KeyVersion, path)
+		}
+		aead, err := newAEAD(keyring.Keys[sealed.KeyVersion])
+		if err != nil {
+			return false, err
+		}
+		if len(sealed.Ciphertext) < aead.NonceSize() {
+			return false, fmt.Errorf("failed to decrypt %s", path)
+		}
+		nonce, ciphertext := sealed.Ciphertext[:aead.NonceSize()], sealed.Ciphertext[aead.NonceSize():]
+		value, err = aead.Open(nil, nonce, ciphertext, []byte(path))
+		if err != nil {
+			return false, fmt.Errorf("failed to decrypt %s", path)
+		}
+	}
+
+	return true, json.Unmarshal(value, v)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (b *backend) readMountKeyring(ctx context.Context, s logical.Storage) (*mountKeyring, error) {
+	entry, err := s.Get(ctx, mountKeyStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	var keyring mountKeyring
+	if err := entry.DecodeJSON(&keyring); err != nil {
+		return nil, err
+	}
+	return &keyring, nil
+}
+
+func (b *backend) writeMountKeyring(ctx context.Context, s logical.Storage, keyring *mountKeyring) error {
+	entry, err := logical.StorageEntryJSON(mountKeyStoragePath, keyring)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
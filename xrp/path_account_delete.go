@@ -0,0 +1,464 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/shopspring/decimal"
+	"log"
+	"time"
+)
+
+// Tombstone records a deleted account for audit purposes. The keys are not kept.
+type Tombstone struct {
+	Name             string    `json:"name"`
+	AccountId        string    `json:"account_id"`
+	PublicKey        string    `json:"public_key"`
+	DeletedAt        time.Time `json:"deleted_at"`
+	DeletedBy        string    `json:"deleted_by"`
+	SweepTxHash      string    `json:"sweep_tx_hash"`
+	SweepDestination string    `json:"sweep_destination"`
+}
+
+func accountDeletePaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/delete",
+			HelpSynopsis: "Sweep and delete an account.",
+			HelpDescription: "Without confirm, signs an AccountDelete transaction sending the remaining XRP to the destination. " +
+				"With confirm=true, removes the account from Vault and keeps a tombstone.",
+			Fields: accountDeleteFields(),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathAccountDelete,
+				logical.UpdateOperation: b.pathAccountDelete,
+			},
+		},
+		&framework.Path{
+			Pattern: "tombstones/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathListTombstones,
+			},
+		},
+		&framework.Path{
+			Pattern:      "tombstones/" + framework.GenericNameRegex("address"),
+			HelpSynopsis: "Show the record of a deleted account",
+			Fields: map[string]*framework.FieldSchema{
+				"address": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathReadTombstone,
+			},
+		},
+	}
+}
+
+// accountDeleteFields is the schema of sweep requests, which is also used to sign sweeps once they are approved
+func accountDeleteFields() map[string]*framework.FieldSchema {
+	return txOptionFields(map[string]*framework.FieldSchema{
+		"name": &framework.FieldSchema{Type: framework.TypeString},
+		"destination": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Vault account name, classic address or X-address that receives the remaining XRP.",
+		},
+		"destination_tag": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: "(Optional) Destination tag for the swept XRP.",
+		},
+		"submit": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "(Optional) Submit the AccountDelete transaction to the ledger.",
+		},
+		"confirm": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "Remove the account from Vault.",
+		},
+		"force": &framework.FieldSchema{
+			Type: framework.TypeBool,
+			Description: "(Optional) Remove the account even if its AccountDelete transaction has not been validated, " +
+				"or sign the AccountDelete offline although the swept amount cannot be checked against the spend limits.",
+		},
+	})
+}
+
+// Signs an AccountDelete sweeping the account, or removes the account once confirmed
+func (b *backend) pathAccountDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if d.Get("confirm").(bool) {
+		return b.deleteAccount(ctx, req, d.Get("name").(string), d.Get("force").(bool))
+	}
+	return b.signAccountDeleteRequest(ctx, req, d, nil)
+}
+
+// signAccountDeleteRequest signs the AccountDelete described by a sweep request. Sweeps above the approval
+// threshold of the account, or of an unknown amount, are held for approval instead, unless they are the
+// approved pending transaction, which is only signed if it still sweeps the approved amount to the approved
+// destination.
+func (b *backend) signAccountDeleteRequest(ctx context.Context, req *logical.Request, d *framework.FieldData, approved *PendingTransaction) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	destination := d.Get("destination").(string)
+	if destination == "" {
+		return errMissingField("destination"), nil
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	path := "accounts/" + name
+	sourceAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if sourceAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+	src, err := data.NewAccountFromAddress(sourceAccount.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	destinationAddress, destinationTag, err := b.resolveDestination(ctx, req, config, destination)
+	if err != nil {
+		return nil, err
+	}
+	if destinationAddress == sourceAccount.AccountId {
+		return logical.ErrorResponse("cannot sweep an account into itself"), nil
+	}
+
+	// Deleting an account costs at least the owner reserve
+	fee, err := data.NewAmount(config.OwnerReserve + "/XRP")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Fee != nil {
+		fee.Value = opts.Fee
+	}
+
+	// The sweep sends the whole balance less the fee, which is held to the spend and velocity limits like a
+	// payment. Offline the balance is unknown, so accounts with limits can only be swept with force, and the
+	// sweep counts as a payment of nothing.
+	var sweep *spendAmount
+	if opts.Offline {
+		if hasAmountLimits(sourceAccount) && !d.Get("force").(bool) {
+			return logical.ErrorResponse("the swept amount cannot be checked against the spend limits of the account offline, use force=true"), nil
+		}
+	} else {
+		sweep, err = b.sweepAmount(config, *src, fee.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = b.enforceSpendPolicy(ctx, req.Storage, sourceAccount, destinationAddress, sweep)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := data.NewAccountFromAddress(destinationAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the basic transaction object
+	accountDeleteTx := &data.AccountDelete{
+		Destination: *dest,
+	}
+	accountDeleteTx.TransactionType = data.ACCOUNT_DELETE
+	accountDeleteTx.Flags = new(data.TransactionFlag)
+	accountDeleteTx.DestinationTag = destinationTag
+
+	if destinationTagRaw, ok := d.GetOk("destination_tag"); ok {
+		tag, err := toUint32(destinationTagRaw.(int))
+		if err != nil {
+			return logical.ErrorResponse("destination_tag " + err.Error()), nil
+		}
+		if destinationTag != nil && *destinationTag != tag {
+			return logical.ErrorResponse("destination_tag does not match the tag in the destination X-address"), nil
+		}
+		accountDeleteTx.DestinationTag = &tag
+	}
+
+	base := accountDeleteTx.GetBase()
+	base.Fee = *fee.Value
+	base.Account = *src
+
+	// Large sweeps need the approval of other operators like payments, as do offline sweeps of accounts with an
+	// approval policy, since their amount is unknown
+	if approved == nil && sourceAccount.ApprovalPolicy.requiresApproval(sweep) {
+		request := make(map[string]interface{}, len(req.Data)+1)
+		for field, value := range req.Data {
+			request[field] = value
+		}
+		request["name"] = name
+		pending, err := newPendingTransaction(req, pendingKindAccountDelete, request, name, destinationAddress, sweep, sourceAccount.ApprovalPolicy)
+		if err != nil {
+			return nil, err
+		}
+		return b.holdForApproval(ctx, req.Storage, pending)
+	}
+	if approved != nil {
+		err = approved.checkApproved(destinationAddress, sweep)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sign the transaction
+	velocitySpend := sweep
+	if velocitySpend == nil {
+		velocitySpend = nativeSpend(decimal.Zero)
+	}
+	signedTx, err := b.signLimitedAccountDelete(ctx, req.Storage, config, sourceAccount, accountDeleteTx, velocitySpend, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	_, txRaw, err := data.Raw(signedTx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember the sweep so the deletion can be checked against it
+	err = b.recordSweep(ctx, req, path, signedTx.Account.String(), signedTx.Hash.String(), destinationAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &logical.Response{
+		Data: map[string]interface{}{
+			"source_address":      signedTx.Account.String(),
+			"destination_address": destinationAddress,
+			"account_sequence":    signedTx.Sequence,
+			"fee":                 signedTx.Fee.String(),
+			"transaction_hash":    signedTx.Hash.String(),
+			"signed_transaction":  fmt.Sprintf("%X", txRaw),
+			"submitted":           false,
+		},
+	}
+
+	if d.Get("submit").(bool) && !opts.Offline {
+		submitResult, err := b.ledger(config).Submit(signedTx)
+		if err != nil {
+			return nil, err
+		}
+		response.Data["engine_result"] = submitResult.EngineResult
+		response.Data["submitted"] = submitSucceeded(submitResult)
+		if !submitSucceeded(submitResult) {
+			response.AddWarning(fmt.Sprintf("AccountDelete was not applied: %s -- %s", submitResult.EngineResult, submitResult.EngineResultMessage))
+		}
+	}
+
+	return response, nil
+}
+
+// recordSweep stores the AccountDelete signed for the account at path. The account is read again under the
+// account lock and only its sweep is changed, so changes made to it while the sweep was signed are kept.
+func (b *backend) recordSweep(ctx context.Context, req *logical.Request, path string, accountId string, txHash string, destination string) error {
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return err
+	}
+	if vaultAccount == nil || vaultAccount.AccountId != accountId {
+		return fmt.Errorf("account %s was deleted or given new keys while AccountDelete %s was signed", path, txHash)
+	}
+	vaultAccount.SweepTxHash = txHash
+	vaultAccount.SweepDestination = destination
+	return b.writeVaultAccount(ctx, req, path, vaultAccount)
+}
+
+// sweepAmount returns the XRP an AccountDelete paying fee sends out of the account: its balance less the fee
+func (b *backend) sweepAmount(config *Config, account data.Account, fee *data.Value) (*spendAmount, error) {
+	accountInfo, err := b.ledger(config).AccountInfo(account)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := decimal.NewFromString(accountInfo.Balance.String())
+	if err != nil {
+		return nil, err
+	}
+	feeAmount, err := decimal.NewFromString(fee.String())
+	if err != nil {
+		return nil, err
+	}
+	swept := balance.Sub(feeAmount)
+	if swept.IsNegative() {
+		swept = decimal.Zero
+	}
+	return nativeSpend(swept), nil
+}
+
+// hasAmountLimits reports whether the spend policy or the velocity limits of the account limit the XRP it can send
+func hasAmountLimits(account *Account) bool {
+	if txLimit, err := decimal.NewFromString(account.TxSpendLimit); err == nil && txLimit.IsPositive() {
+		return true
+	}
+	if _, ok := account.CurrencySpendLimits[nativeCurrency]; ok {
+		return true
+	}
+	for _, limit := range account.VelocityLimits {
+		if maxAmount, err := decimal.NewFromString(limit.MaxAmount); err == nil && maxAmount.IsPositive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the account from Vault, keeping a tombstone. Accounts still on the ledger can only be removed with
+// accounts/<name>/delete and force=true.
+func (b *backend) pathDeleteAccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.deleteAccount(ctx, req, d.Get("name").(string), false)
+}
+
+// deleteAccount writes a tombstone and removes the account. Unless force is set, the AccountDelete signed
+// for the account must have been validated on the ledger, or, if the account was never swept, the account
+// must not exist on the ledger, so the keys of a funded account are never discarded by accident.
+func (b *backend) deleteAccount(ctx context.Context, req *logical.Request, name string, force bool) (*logical.Response, error) {
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + name
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, nil
+	}
+
+	if !force {
+		config, err := b.readConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if config.Offline {
+			return logical.ErrorResponse("cannot verify that the account is no longer on the ledger on an offline mount, use force=true"), nil
+		}
+		if vaultAccount.SweepTxHash != "" {
+			err = b.txValidated(config, vaultAccount.SweepTxHash)
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("AccountDelete %s", err)), nil
+			}
+		} else {
+			err = b.accountAbsent(config, vaultAccount.AccountId)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+	}
+
+	deletedBy := req.EntityID
+	if deletedBy == "" {
+		deletedBy = req.DisplayName
+	}
+	tombstone := &Tombstone{
+		Name:             name,
+		AccountId:        vaultAccount.AccountId,
+		PublicKey:        vaultAccount.PublicKey,
+		DeletedAt:        time.Now().UTC(),
+		DeletedBy:        deletedBy,
+		SweepTxHash:      vaultAccount.SweepTxHash,
+		SweepDestination: vaultAccount.SweepDestination,
+	}
+	entry, err := logical.StorageEntryJSON("tombstones/"+vaultAccount.AccountId, tombstone)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Delete(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Delete(ctx, spendLedgerStoragePrefix+vaultAccount.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("deleted account %s (%s)", name, vaultAccount.AccountId)
+
+	return tombstoneResponse(tombstone), nil
+}
+
+// accountAbsent returns an error unless the ledger reports that the account does not exist
+func (b *backend) accountAbsent(config *Config, accountId string) error {
+	account, err := data.NewAccountFromAddress(accountId)
+	if err != nil {
+		return err
+	}
+	_, err = b.ledger(config).AccountInfo(*account)
+	if err == nil {
+		return fmt.Errorf("account %s still exists on the ledger, sweep it with an AccountDelete first or use force=true", accountId)
+	}
+	if !accountNotFound(err) {
+		return fmt.Errorf("cannot verify that account %s is no longer on the ledger: %s", accountId, err)
+	}
+	return nil
+}
+
+// Returns the addresses of deleted accounts
+func (b *backend) pathListTombstones(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	tombstones, err := req.Storage.List(ctx, "tombstones/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(tombstones), nil
+}
+
+// Returns the tombstone of a deleted account
+func (b *backend) pathReadTombstone(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := req.Storage.Get(ctx, "tombstones/"+d.Get("address").(string))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var tombstone Tombstone
+	err = entry.DecodeJSON(&tombstone)
+	if err != nil {
+		return nil, err
+	}
+	return tombstoneResponse(&tombstone), nil
+}
+
+func tombstoneResponse(tombstone *Tombstone) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":              tombstone.Name,
+			"account_id":        tombstone.AccountId,
+			"public_key":        tombstone.PublicKey,
+			"deleted_at":        tombstone.DeletedAt.Format(time.RFC3339),
+			"deleted_by":        tombstone.DeletedBy,
+			"sweep_tx_hash":     tombstone.SweepTxHash,
+			"sweep_destination": tombstone.SweepDestination,
+		},
+	}
+}
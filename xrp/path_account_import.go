@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/rubblelabs/ripple/crypto"
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/ed25519"
+	"log"
+	"strings"
+)
+
+func accountImportPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/import",
+			HelpSynopsis: "Import an existing Ripple account from a family seed, RFC1751 words or a hex private key",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"seed": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Family seed of the account (sXXXX, or sEdXXXX for an Ed25519 key)",
+				},
+				"rfc1751": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "The 12 RFC1751 words of the family seed, as shown by rippled's wallet_propose",
+				},
+				"private_key": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Hex encoded private key of the account. Ed25519 keys are prefixed with ED.",
+				},
+				"key_type": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Type of key derived from a plain seed or RFC1751 words, secp256k1 or ed25519. sEd seeds are always Ed25519.",
+					Default:     keyTypeSecp256k1,
+				},
+				"expected_address": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Address the imported key must derive to",
+				},
+				"tx_spend_limit": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum amount of tokens which can be sent in a single transaction",
+					Default:     "0",
+				},
+				"whitelist": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of accounts that this account can transact with.",
+				},
+				"blacklist": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of accounts that this account is forbidden from transacting with.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathImportAccount,
+				logical.UpdateOperation: b.pathImportAccount,
+			},
+		},
+	}
+}
+
+// Stores an existing key pair as a new account. Imported accounts are assumed to be funded already.
+func (b *backend) pathImportAccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	seed := strings.TrimSpace(d.Get("seed").(string))
+	words := strings.TrimSpace(d.Get("rfc1751").(string))
+	privateKey := strings.TrimSpace(d.Get("private_key").(string))
+	expectedAddress := d.Get("expected_address").(string)
+	keyType := d.Get("key_type").(string)
+
+	given := 0
+	for _, value := range []string{seed, words, privateKey} {
+		if value != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return logical.ErrorResponse("exactly one of seed, rfc1751 or private_key is required"), nil
+	}
+	if !contains(keyTypes, keyType) {
+		return logical.ErrorResponse(fmt.Sprintf("key_type must be one of %v", keyTypes)), nil
+	}
+
+	txSpendLimit, err := decimal.NewFromString(d.Get("tx_spend_limit").(string))
+	if err != nil || txSpendLimit.IsNegative() {
+		return logical.ErrorResponse("tx_spend_limit is either not a number or is negative"), nil
+	}
+
+	accountPath := "accounts/" + name
+	existing, err := req.Storage.Get(ctx, accountPath)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return logical.ErrorResponse(fmt.Sprintf("account %s already exists", name)), nil
+	}
+
+	var account *Account
+	switch {
+	case seed != "":
+		account, err = accountFromSeed(keyType, seed)
+	case words != "":
+		account, err = accountFromRFC1751(keyType, words)
+	default:
+		account, err = accountFromPrivateKey(privateKey)
+	}
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if expectedAddress != "" && expectedAddress != account.AccountId {
+		return logical.ErrorResponse(fmt.Sprintf("key derives to %s, not the expected address %s", account.AccountId, expectedAddress)), nil
+	}
+
+	account.TxSpendLimit = txSpendLimit.String()
+	if whitelistRaw, ok := d.GetOk("whitelist"); ok {
+		account.Whitelist = whitelistRaw.([]string)
+	}
+	if blacklistRaw, ok := d.GetOk("blacklist"); ok {
+		account.Blacklist = blacklistRaw.([]string)
+	}
+
+	err = b.writeVaultAccount(ctx, req, accountPath, account)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("successfully imported account %v", account.AccountId)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"accountId":    account.AccountId,
+			"publicKey":    account.PublicKey,
+			"keyType":      account.KeyType,
+			"txSpendLimit": account.TxSpendLimit,
+			"whitelist":    account.Whitelist,
+			"blacklist":    account.Blacklist,
+		},
+	}, nil
+}
+
+// Derives an account from a family seed, the same way generated accounts are derived. "sEd..." seeds
+// always derive an Ed25519 key, plain seeds derive a key of the given type.
+func accountFromSeed(keyType string, seed string) (*Account, error) {
+	rawSeed, seedKeyType, err := decodeFamilySeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed: %s", err)
+	}
+	if seedKeyType != "" {
+		keyType = seedKeyType
+	}
+	return accountFromSeedBytes(keyType, rawSeed)
+}
+
+// Derives an account from the RFC1751 words of a family seed
+func accountFromRFC1751(keyType string, words string) (*Account, error) {
+	rawSeed, err := rfc1751SeedFromWords(words)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rfc1751: %s", err)
+	}
+	return accountFromSeedBytes(keyType, rawSeed)
+}
+
+// Derives an account from the 16 bytes of a family seed and stores the encoded seed as its secret
+func accountFromSeedBytes(keyType string, rawSeed []byte) (*Account, error) {
+	key, keySequence, err := seedKey(keyType, rawSeed)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := accountFromKey(key, keySequence)
+	if err != nil {
+		return nil, err
+	}
+	account.Secret, err = encodeFamilySeed(keyType, rawSeed)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Derives an account from a raw hex private key. Accounts imported this way have no seed.
+func accountFromPrivateKey(privateKeyHex string) (*Account, error) {
+	raw, err := hex.DecodeString(privateKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("private_key is not valid hex")
+	}
+	key, err := parsePrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return accountFromKey(key, nil)
+}
+
+// Computes the address and the encoded keys of an account
+func accountFromKey(key crypto.Key, sequence *uint32) (*Account, error) {
+	publicKeyHash, err := crypto.AccountPublicKey(key, sequence)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyHash, err := crypto.AccountPrivateKey(key, sequence)
+	if err != nil {
+		return nil, err
+	}
+	accountIdHash, err := crypto.AccountId(key, sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	keyType := keyTypeSecp256k1
+	if key.Type() == crypto.Ed25519 {
+		keyType = keyTypeEd25519
+	}
+	return &Account{
+		AccountId:  accountIdHash.String(),
+		PublicKey:  publicKeyHash.String(),
+		PrivateKey: privateKeyHash.String(),
+		KeyType:    keyType,
+	}, nil
+}
+
+// Parses a raw private key. Accepted forms are a 32 byte secp256k1 key (optionally with a leading 00, as used by
+// rippled), a 32 byte ed25519 seed prefixed with ED, and a 64 byte ed25519 private key as stored by this backend.
+func parsePrivateKey(raw []byte) (crypto.Key, error) {
+	switch {
+	case len(raw) == ed25519.SeedSize+1 && raw[0] == 0xED:
+		return &ed25519Key{ed25519.NewKeyFromSeed(raw[1:])}, nil
+	case len(raw) == ed25519.PrivateKeySize:
+		return &ed25519Key{ed25519.PrivateKey(raw)}, nil
+	case len(raw) == btcec.PrivKeyBytesLen+1 && raw[0] == 0:
+		raw = raw[1:]
+	}
+	if len(raw) != btcec.PrivKeyBytesLen {
+		return nil, fmt.Errorf("private_key must be a %d byte secp256k1 key or an ED prefixed ed25519 key", btcec.PrivKeyBytesLen)
+	}
+
+	privateKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), raw)
+	if privateKey.D.Sign() == 0 || privateKey.D.Cmp(btcec.S256().N) >= 0 {
+		return nil, fmt.Errorf("private_key is not a valid secp256k1 key")
+	}
+	return &ecdsaKey{privateKey}, nil
+}
+
+// ecdsaKey and ed25519Key implement crypto.Key for bare keys. The key sequence does not apply and is ignored.
+
+func (k *ecdsaKey) Private(sequence *uint32) []byte {
+	private := make([]byte, btcec.PrivKeyBytesLen)
+	d := k.D.Bytes()
+	copy(private[len(private)-len(d):], d)
+	return private
+}
+
+func (k *ecdsaKey) Public(sequence *uint32) []byte {
+	return k.PubKey().SerializeCompressed()
+}
+
+func (k *ecdsaKey) Id(sequence *uint32) []byte {
+	return sha256RipeMD160(k.Public(sequence))
+}
+
+func (k *ecdsaKey) Type() crypto.KeyType {
+	return crypto.ECDSA
+}
+
+type ed25519Key struct {
+	ed25519.PrivateKey
+}
+
+func (k *ed25519Key) Private(sequence *uint32) []byte {
+	return k.PrivateKey
+}
+
+func (k *ed25519Key) Public(sequence *uint32) []byte {
+	return append([]byte{0xED}, k.PrivateKey.Public().(ed25519.PublicKey)...)
+}
+
+func (k *ed25519Key) Id(sequence *uint32) []byte {
+	return sha256RipeMD160(k.Public(sequence))
+}
+
+func (k *ed25519Key) Type() crypto.KeyType {
+	return crypto.Ed25519
+}
@@ -24,29 +24,62 @@ import (
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
-	"github.com/rubblelabs/ripple/crypto"
 	"github.com/rubblelabs/ripple/data"
-	"github.com/rubblelabs/ripple/websockets"
 	"github.com/shopspring/decimal"
 	"io"
 	"log"
-	"net/http"
 	"strconv"
 )
 
+const (
+	keyTypeSecp256k1 = "secp256k1"
+	keyTypeEd25519   = "ed25519"
+)
+
+var keyTypes = []string{keyTypeSecp256k1, keyTypeEd25519}
+
 type ecdsaKey struct {
 	*btcec.PrivateKey
 }
 
 // Account is a Ripple account
 type Account struct {
+	SchemaVersion int `json:"schema_version"`
+
 	AccountId    string   `json:"account_id"`
 	PublicKey    string   `json:"public_key"`
-	PrivateKey   string   `json:"private_key"`
+	PrivateKey   string   `json:"private_key,omitempty"`
 	Secret       string   `json:"secret"`
+	KeyType      string   `json:"key_type,omitempty"`
 	TxSpendLimit string   `json:"tx_spend_limit"`
 	Whitelist    []string `json:"whitelist"`
 	Blacklist    []string `json:"blacklist"`
+
+	// Per-transaction limits by currency, keyed by "XRP" or "<currency>/<issuer>"
+	CurrencySpendLimits map[string]string `json:"currency_spend_limits,omitempty"`
+
+	// Set once an AccountDelete sweeping the account has been signed
+	SweepTxHash      string `json:"sweep_tx_hash,omitempty"`
+	SweepDestination string `json:"sweep_destination,omitempty"`
+
+	// Set on accounts derived from a wallet, whose keys are not stored
+	Wallet      string `json:"wallet,omitempty"`
+	WalletIndex uint32 `json:"wallet_index,omitempty"`
+
+	// Once active, the regular key signs all transactions of the account in place of the master key
+	RegularKey          *RegularKey          `json:"regular_key,omitempty"`
+	PendingRegularKey   *RegularKey          `json:"pending_regular_key,omitempty"`
+	DisableMasterTxHash string               `json:"disable_master_tx_hash,omitempty"`
+	RegularKeyHistory   []*RetiredRegularKey `json:"regular_key_history,omitempty"`
+
+	// Set to rotate the regular key automatically
+	RotationPolicy *RotationPolicy `json:"rotation_policy,omitempty"`
+
+	// Rolling-window limits on the payments signed by the account, by name
+	VelocityLimits map[string]*VelocityLimit `json:"velocity_limits,omitempty"`
+
+	// Set to hold large payments until other operators approve them
+	ApprovalPolicy *ApprovalPolicy `json:"approval_policy,omitempty"`
 }
 
 func accountsPaths(b *backend) []*framework.Path {
@@ -60,7 +93,7 @@ func accountsPaths(b *backend) []*framework.Path {
 		&framework.Path{
 			Pattern:      "accounts/" + framework.GenericNameRegex("name"),
 			HelpSynopsis: "Create a new Ripple account",
-			Fields: map[string]*framework.FieldSchema{
+			Fields: txOptionFields(map[string]*framework.FieldSchema{
 				"name": &framework.FieldSchema{Type: framework.TypeString},
 				"xrp_balance": &framework.FieldSchema{
 					Type:        framework.TypeString,
@@ -70,11 +103,20 @@ func accountsPaths(b *backend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "(Optional) Account used to fund the starting balance",
 				},
+				"submit": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Submit the funding payment to the ledger. If false the signed payment is only returned.",
+					Default:     true,
+				},
 				"tx_spend_limit": &framework.FieldSchema{
 					Type:        framework.TypeString,
 					Description: "(Optional) Maximum amount of tokens which can be sent in a single transaction",
 					Default:     "0",
 				},
+				"currency_spend_limits": &framework.FieldSchema{
+					Type:        framework.TypeMap,
+					Description: "(Optional) Maximum amount sent in a single transaction by currency, keyed by 'XRP' or '<currency>/<issuer>'",
+				},
 				"whitelist": &framework.FieldSchema{
 					Type:        framework.TypeCommaStringSlice,
 					Description: "(Optional) The list of accounts that this account can transact with.",
@@ -83,17 +125,28 @@ func accountsPaths(b *backend) []*framework.Path {
 					Type:        framework.TypeCommaStringSlice,
 					Description: "(Optional) The list of accounts that this account is forbidden from transacting with.",
 				},
-			},
+				"key_type": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Type of key to generate, secp256k1 or ed25519",
+					Default:     keyTypeSecp256k1,
+				},
+				"replace_keys": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) When writing to an existing account, generate a new key pair. The old keys are discarded.",
+				},
+			}),
+			ExistenceCheck: b.pathAccountExistenceCheck,
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.pathCreateAccount,
-				logical.UpdateOperation: b.pathCreateAccount,
+				logical.UpdateOperation: b.pathUpdateAccount,
 				logical.ReadOperation:   b.pathReadAccount,
+				logical.DeleteOperation: b.pathDeleteAccount,
 			},
 		},
 		&framework.Path{
 			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/accountset",
 			HelpSynopsis: "Set options on an account.",
-			Fields: map[string]*framework.FieldSchema{
+			Fields: txOptionFields(map[string]*framework.FieldSchema{
 				"name": &framework.FieldSchema{Type: framework.TypeString},
 				"setFlag": &framework.FieldSchema{
 					Type:        framework.TypeString,
@@ -107,7 +160,7 @@ func accountsPaths(b *backend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "Domain that owns this account.",
 				},
-			},
+			}),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.pathAccountSet,
 				logical.UpdateOperation: b.pathAccountSet,
@@ -116,7 +169,7 @@ func accountsPaths(b *backend) []*framework.Path {
 		&framework.Path{
 			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/trustline",
 			HelpSynopsis: "Creates a trustline for an issued currency.",
-			Fields: map[string]*framework.FieldSchema{
+			Fields: txOptionFields(map[string]*framework.FieldSchema{
 				"name": &framework.FieldSchema{Type: framework.TypeString},
 				"currencyCode": &framework.FieldSchema{
 					Type:        framework.TypeString,
@@ -130,7 +183,7 @@ func accountsPaths(b *backend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "Maximum amount for this trustline.",
 				},
-			},
+			}),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.pathCreateTrustline,
 				logical.UpdateOperation: b.pathCreateTrustline,
@@ -148,7 +201,7 @@ func (b *backend) pathListAccounts(ctx context.Context, req *logical.Request, d
 	return logical.ListResponse(accountList), nil
 }
 
-// Generates and stores an secp256k1 asymmetric key pair
+// Generates and stores a secp256k1 or ed25519 asymmetric key pair
 func (b *backend) pathCreateAccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (response *logical.Response, err error) {
 	// Validate we didn't get extra fields
 	//err := validateFields(req, d)
@@ -172,88 +225,269 @@ func (b *backend) pathCreateAccount(ctx context.Context, req *logical.Request, d
 		return nil, fmt.Errorf("tx_spend_limit is either not a number or is negative")
 	}
 
-	// Generate a random secp256k1 (unable to use ed25519 due to bugs in Ripple re: payment channel signing)
-	rawSeed := make([]byte, 16)
-	_, err = io.ReadFull(rand.Reader, rawSeed[:])
+	var currencySpendLimits map[string]string
+	if currencySpendLimitsRaw, ok := d.GetOk("currency_spend_limits"); ok {
+		currencySpendLimits, err = parseCurrencySpendLimits(currencySpendLimitsRaw.(map[string]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	var xrpBalance decimal.Decimal
+	xrpBalanceString := d.Get("xrp_balance").(string)
+	if xrpBalanceString != "" {
+		xrpBalance, err = decimal.NewFromString(xrpBalanceString)
+		if err != nil || !xrpBalance.IsPositive() {
+			return logical.ErrorResponse("xrp_balance must be a positive number"), nil
+		}
+	}
+
+	sourceAccountName := d.Get("source_account_name").(string)
+	if sourceAccountName != "" && xrpBalanceString == "" {
+		return errMissingField("xrp_balance"), nil
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	submit := d.Get("submit").(bool) && !opts.Offline
 
-	seedHash, err := crypto.NewFamilySeed(rawSeed)
+	keyType := d.Get("key_type").(string)
+	if !contains(keyTypes, keyType) {
+		return logical.ErrorResponse(fmt.Sprintf("key_type must be one of %v", keyTypes)), nil
+	}
+
+	// Generate a random key pair of the requested type
+	accountJSON, err := generateAccountKeys(keyType)
+	if err != nil {
+		Log(err)
+		return nil, err
+	}
+	accountJSON.TxSpendLimit = txSpendLimit.String()
+	accountJSON.Whitelist = whitelist
+	accountJSON.Blacklist = blacklist
+	accountJSON.CurrencySpendLimits = currencySpendLimits
+
+	// Prepare the payment funding the new account, either from the requested source account or
+	// according to the mount configuration. It is only submitted, or held for approval, once the
+	// account has been stored.
+	var fundingTx *data.Payment
+	var fundingPending *PendingTransaction
+	if sourceAccountName != "" {
+		fundingTx, fundingPending, err = b.prepareSourceFunding(ctx, req, config, sourceAccountName, accountJSON.AccountId, xrpBalance, opts)
+	} else {
+		fundingAmount := config.FundingAmount
+		if xrpBalanceString != "" {
+			fundingAmount = xrpBalance.String()
+		}
+		fundingTx, fundingPending, err = b.prepareMountFunding(ctx, req, config, accountJSON.AccountId, fundingAmount)
+	}
 	if err != nil {
 		Log(err)
 		return nil, err
 	}
 
-	ecdsaKey, err := crypto.NewECDSAKey(seedHash.Payload())
+	// Store the Account object in Vault
+	err = b.writeVaultAccount(ctx, req, req.Path, accountJSON)
 	if err != nil {
 		Log(err)
 		return nil, err
 	}
 
-	keySequenceZero := uint32(0)
+	log.Printf("successfully created account %v", accountJSON.AccountId)
+
+	response = &logical.Response{
+		Data: map[string]interface{}{
+			"accountId":    accountJSON.AccountId,
+			"publicKey":    accountJSON.PublicKey,
+			"keyType":      accountJSON.KeyType,
+			"txSpendLimit": txSpendLimit.String(),
+			"whitelist":    whitelist,
+			"blacklist":    blacklist,
+		},
+	}
+	if len(currencySpendLimits) > 0 {
+		response.Data["currencySpendLimits"] = currencySpendLimits
+	}
+	if fundingPending != nil {
+		_, err = b.holdForApproval(ctx, req.Storage, fundingPending)
+		if err != nil {
+			return nil, err
+		}
+		response.Data["funding_amount"] = fundingPending.Amount
+		response.Data["funding_pending_id"] = fundingPending.ID
+		response.Data["funding_submitted"] = false
+		return response, nil
+	}
+	if fundingTx == nil {
+		return response, nil
+	}
 
-	publicKeyHash, err := crypto.AccountPublicKey(ecdsaKey, &keySequenceZero)
+	_, txRaw, err := data.Raw(fundingTx)
 	if err != nil {
-		Log(err)
 		return nil, err
 	}
+	response.Data["funding_source_address"] = fundingTx.Account.String()
+	response.Data["funding_amount"] = fundingTx.Amount.String()
+	response.Data["funding_transaction_hash"] = fundingTx.Hash.String()
+	response.Data["funding_signed_transaction"] = fmt.Sprintf("%X", txRaw)
+	response.Data["funding_submitted"] = false
 
-	privateKeyHash, err := crypto.AccountPrivateKey(ecdsaKey, &keySequenceZero)
+	if submit {
+		submitResult, err := b.submitFunding(config, fundingTx)
+		if submitResult != nil {
+			response.Data["funding_engine_result"] = submitResult.EngineResult
+		}
+		if err != nil {
+			// The account has been stored, so report the failure without failing the request
+			Log(err)
+			response.AddWarning(fmt.Sprintf("account created but not funded: %s", err))
+			return response, nil
+		}
+		response.Data["funding_submitted"] = true
+	}
+
+	return response, nil
+}
+
+// generateAccountKeys derives a key pair of the given type from a new random family seed
+func generateAccountKeys(keyType string) (*Account, error) {
+	rawSeed := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, rawSeed[:])
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a Ripple account id from the public key
-	accountIdHash, err := crypto.AccountId(ecdsaKey, &keySequenceZero)
+	return accountFromSeedBytes(keyType, rawSeed)
+}
+
+// Reports whether an account is already stored at the request path
+func (b *backend) pathAccountExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	entry, err := req.Storage.Get(ctx, req.Path)
+	if err != nil {
+		return false, err
+	}
+	return entry != nil, nil
+}
+
+// Updates the policy fields of an existing account. The keys are only replaced if replace_keys is set.
+func (b *backend) pathUpdateAccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	for _, field := range []string{"xrp_balance", "source_account_name"} {
+		if _, ok := d.GetOk(field); ok {
+			return logical.ErrorResponse(fmt.Sprintf("%s can only be set when creating an account", field)), nil
+		}
+	}
+
+	// Serialize with the regular key and velocity limit writers, which also rewrite the account
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+	b.spendLock.Lock()
+	defer b.spendLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	vaultAccount, err := b.readVaultAccount(ctx, req, req.Path)
 	if err != nil {
-		Log(err)
 		return nil, err
 	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+
+	if txSpendLimitRaw, ok := d.GetOk("tx_spend_limit"); ok {
+		txSpendLimit, err := decimal.NewFromString(txSpendLimitRaw.(string))
+		if err != nil || txSpendLimit.IsNegative() {
+			return logical.ErrorResponse("tx_spend_limit is either not a number or is negative"), nil
+		}
+		vaultAccount.TxSpendLimit = txSpendLimit.String()
+	}
+	if whitelistRaw, ok := d.GetOk("whitelist"); ok {
+		vaultAccount.Whitelist = whitelistRaw.([]string)
+	}
+	if blacklistRaw, ok := d.GetOk("blacklist"); ok {
+		vaultAccount.Blacklist = blacklistRaw.([]string)
+	}
+	if currencySpendLimitsRaw, ok := d.GetOk("currency_spend_limits"); ok {
+		vaultAccount.CurrencySpendLimits, err = parseCurrencySpendLimits(currencySpendLimitsRaw.(map[string]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
 
-	// Prod anchor
-	//err = fundAccount(address)
+	if d.Get("replace_keys").(bool) {
+		return b.replaceAccountKeys(ctx, req, d, vaultAccount)
+	}
 
-	// Testnet
-	err = fundTestAccount(accountIdHash.String())
+	err = b.writeVaultAccount(ctx, req, req.Path, vaultAccount)
 	if err != nil {
-		Log(err)
 		return nil, err
 	}
 
-	// Create and store an Account object in Vault
-	accountJSON := &Account{
-		AccountId:    accountIdHash.String(),
-		PublicKey:    publicKeyHash.String(),
-		PrivateKey:   privateKeyHash.String(),
-		Secret:       seedHash.String(),
-		TxSpendLimit: txSpendLimit.String(),
-		Whitelist:    whitelist,
-		Blacklist:    blacklist}
+	return b.pathReadAccount(ctx, req, d)
+}
 
-	entry, err := logical.StorageEntryJSON(req.Path, accountJSON)
+// replaceAccountKeys gives an existing account a new key pair, and so a new address, keeping its policies.
+// The new address is not funded. Regular keys and wallet links belong to the old address and are dropped.
+// Called with rotationLock and spendLock held.
+func (b *backend) replaceAccountKeys(ctx context.Context, req *logical.Request, d *framework.FieldData, vaultAccount *Account) (*logical.Response, error) {
+	keyType := vaultAccount.KeyType
+	if keyTypeRaw, ok := d.GetOk("key_type"); ok {
+		keyType = keyTypeRaw.(string)
+	}
+	if keyType == "" {
+		keyType = keyTypeSecp256k1
+	}
+	if !contains(keyTypes, keyType) {
+		return logical.ErrorResponse(fmt.Sprintf("key_type must be one of %v", keyTypes)), nil
+	}
+
+	newKeys, err := generateAccountKeys(keyType)
 	if err != nil {
-		Log(err)
 		return nil, err
 	}
 
-	err = req.Storage.Put(ctx, entry)
+	oldAccountId := vaultAccount.AccountId
+	vaultAccount.AccountId = newKeys.AccountId
+	vaultAccount.PublicKey = newKeys.PublicKey
+	vaultAccount.PrivateKey = ""
+	vaultAccount.Secret = newKeys.Secret
+	vaultAccount.KeyType = newKeys.KeyType
+	vaultAccount.Wallet = ""
+	vaultAccount.WalletIndex = 0
+	vaultAccount.RegularKey = nil
+	vaultAccount.PendingRegularKey = nil
+	vaultAccount.DisableMasterTxHash = ""
+	vaultAccount.SweepTxHash = ""
+	vaultAccount.SweepDestination = ""
+
+	// Payments signed with the old keys keep counting towards the velocity limits
+	ledger, err := b.readSpendLedger(ctx, req.Storage, oldAccountId)
 	if err != nil {
-		Log(err)
 		return nil, err
 	}
+	if len(ledger.Records) > 0 {
+		err = b.writeSpendLedger(ctx, req.Storage, vaultAccount.AccountId, ledger)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	log.Printf("successfully created account %v", accountJSON.AccountId)
+	err = b.writeVaultAccount(ctx, req, req.Path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Delete(ctx, spendLedgerStoragePrefix+oldAccountId)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("replaced keys of account at %s, %s is now %s", req.Path, oldAccountId, vaultAccount.AccountId)
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"accountId":    accountJSON.AccountId,
-			"publicKey":    accountJSON.PublicKey,
-			"txSpendLimit": txSpendLimit.String(),
-			"whitelist":    whitelist,
-			"blacklist":    blacklist,
-		},
-	}, nil
+	return b.pathReadAccount(ctx, req, d)
 }
 
 // Returns account details for the given account
@@ -261,8 +495,7 @@ func (b *backend) pathReadAccount(ctx context.Context, req *logical.Request, d *
 
 	vaultAccount, err := b.readVaultAccount(ctx, req, req.Path)
 	if err != nil {
-		log.Fatal(err)
-		return nil, fmt.Errorf("error reading account")
+		return nil, err
 	}
 	if vaultAccount == nil {
 		return nil, nil
@@ -273,16 +506,36 @@ func (b *backend) pathReadAccount(ctx context.Context, req *logical.Request, d *
 	blacklist := &vaultAccount.Blacklist
 	accountId := &vaultAccount.AccountId
 	txSpendLimit := &vaultAccount.TxSpendLimit
+	keyType := vaultAccount.KeyType
+	if keyType == "" {
+		keyType = keyTypeSecp256k1
+	}
 
-	return &logical.Response{
+	response := &logical.Response{
 		Data: map[string]interface{}{
 			"accountId":    accountId,
 			"publicKey":    publicKey,
+			"keyType":      keyType,
 			"txSpendLimit": txSpendLimit,
 			"whitelist":    whitelist,
 			"blacklist":    blacklist,
 		},
-	}, nil
+	}
+	if vaultAccount.Wallet != "" {
+		response.Data["wallet"] = vaultAccount.Wallet
+		response.Data["walletIndex"] = vaultAccount.WalletIndex
+	}
+	if len(vaultAccount.CurrencySpendLimits) > 0 {
+		response.Data["currencySpendLimits"] = vaultAccount.CurrencySpendLimits
+	}
+	if len(vaultAccount.VelocityLimits) > 0 {
+		velocityLimits, err := b.velocityLimitsData(ctx, req.Storage, vaultAccount)
+		if err != nil {
+			return nil, err
+		}
+		response.Data["velocityLimits"] = velocityLimits
+	}
+	return response, nil
 }
 
 // Set account flags
@@ -292,6 +545,15 @@ func (b *backend) pathAccountSet(ctx context.Context, req *logical.Request, d *f
 	clearFlagStr := d.Get("clearFlag").(string)
 	domainStr := d.Get("domain").(string)
 
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
 	// Retrieve the account keypair from vault storage
 	sourceAccount, err := b.readVaultAccount(ctx, req, "accounts/"+name)
 	if err != nil {
@@ -341,7 +603,7 @@ func (b *backend) pathAccountSet(ctx context.Context, req *logical.Request, d *f
 	}
 
 	// Sign the transaction
-	signedTx, err := signAccountSetTransaction(sourceAccount, accountSetTx)
+	signedTx, err := b.signAccountSetTransaction(ctx, req.Storage, config, sourceAccount, accountSetTx, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -381,6 +643,15 @@ func (b *backend) pathCreateTrustline(ctx context.Context, req *logical.Request,
 		return errMissingField("limit"), nil
 	}
 
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
 	// Retrieve the account keypair from vault storage
 	sourceAccount, err := b.readVaultAccount(ctx, req, "accounts/"+name)
 	if err != nil {
@@ -395,6 +666,12 @@ func (b *backend) pathCreateTrustline(ctx context.Context, req *logical.Request,
 		return nil, err
 	}
 
+	// Refuse to trust an issuer on the mount denylist
+	err = b.checkDenylist(ctx, req.Storage, issuer)
+	if err != nil {
+		return nil, err
+	}
+
 	// Set up the basic transaction object
 	limitAmount, err := data.NewAmount(limit + "/" + currencyCode + "/" + issuer)
 	if err != nil {
@@ -413,7 +690,7 @@ func (b *backend) pathCreateTrustline(ctx context.Context, req *logical.Request,
 	base.Account = *src
 
 	// Sign the transaction
-	signedTx, err := signTrustSetTransaction(sourceAccount, trustSetTx)
+	signedTx, err := b.signTrustSetTransaction(ctx, req.Storage, config, sourceAccount, trustSetTx, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -434,90 +711,40 @@ func (b *backend) pathCreateTrustline(ctx context.Context, req *logical.Request,
 	}, nil
 }
 
-func (b *backend) readVaultAccount(ctx context.Context, req *logical.Request, path string) (*Account, error) {
-	log.Print("Reading account from path: " + path)
-	entry, err := req.Storage.Get(ctx, path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read account at %s", path)
-	}
-	if entry == nil || len(entry.Value) == 0 {
-		return nil, nil
-	}
-
-	var account Account
-	err = entry.DecodeJSON(&account)
-
-	if entry == nil {
-		return nil, fmt.Errorf("failed to deserialize account at %s", path)
+// writeVaultAccount stores the account, encrypted with the mount key if envelope encryption is enabled. The private
+// key is only stored for accounts without a seed; otherwise it is derived from the seed when needed.
+func (b *backend) writeVaultAccount(ctx context.Context, req *logical.Request, path string, account *Account) error {
+	stored := *account
+	stored.SchemaVersion = accountSchemaVersion
+	if stored.Secret != "" {
+		stored.PrivateKey = ""
 	}
-
-	return &account, err
+	return b.putEncrypted(ctx, req.Storage, path, &stored)
 }
 
-// Using the Ripple testnet faucet, create a funded test account, then transfer them to our new test account
-func fundTestAccount(address string) (err error) {
-	faucetAddress, faucetSecret, err := generateTestFaucetAccount()
-	if err != nil {
-		Log(err)
-		return err
-	}
-
-	// Send the XRP over to our target address
-	payment, err := createPaymentTransaction(faucetAddress, address, "1000", "native", "")
-	if err != nil {
-		Log(err)
-		return err
-	}
-
-	faucetAccount := &Account{
-		AccountId: faucetAddress,
-		Secret:    faucetSecret}
-
-	signedTx, err := signPaymentTransaction(faucetAccount, payment)
+// readVaultAccount reads the account, upgrading records written with an older schema version. The upgraded
+// record is written back unless the storage is read-only, e.g. on a performance standby.
+func (b *backend) readVaultAccount(ctx context.Context, req *logical.Request, path string) (*Account, error) {
+	log.Print("Reading account from path: " + path)
+	var raw json.RawMessage
+	found, err := b.getEncrypted(ctx, req.Storage, path, &raw)
 	if err != nil {
-		Log(err)
-		return err
+		return nil, fmt.Errorf("failed to read account at %s: %s", path, err)
 	}
-
-	remote, err := websockets.NewRemote("wss://s.altnet.rippletest.net:51233")
-	if err != nil {
-		Log(err)
-		return err
+	if !found {
+		return nil, nil
 	}
 
-	submitResult, err := remote.Submit(signedTx)
+	account, migrated, err := decodeAccountRecord(raw)
 	if err != nil {
-		Log(err)
-		return err
-	}
-	log.Printf("Submitted transaction result : %s -- %s", submitResult.EngineResult.String(), submitResult.EngineResultMessage)
-
-	return nil
-}
-
-func generateTestFaucetAccount() (string, string, error) {
-	resp, err := http.Post("https://faucet.altnet.rippletest.net/accounts", "application/json", nil)
-	Fatal(err, "Unable to POST to Ripple TestNet faucet endpoint")
-	defer resp.Body.Close()
-
-	type Account struct {
-		Address string
-		Secret  string
+		return nil, fmt.Errorf("failed to read account at %s: %s", path, err)
 	}
-
-	type Container struct {
-		Account Account
-		Balance string
+	if migrated {
+		err = b.writeVaultAccount(ctx, req, path, account)
+		if err != nil && err != logical.ErrReadOnly {
+			return nil, err
+		}
+		log.Printf("migrated account at %s to schema version %d", path, accountSchemaVersion)
 	}
-
-	result := &Container{}
-
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	faucetAddress := result.Account.Address
-	faucetSecret := result.Account.Secret
-
-	log.Print("Generated faucet account '" + faucetAddress + "' with secret '" + faucetSecret + "'")
-
-	return faucetAddress, faucetSecret, nil
+	return account, nil
 }
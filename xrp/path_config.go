@@ -0,0 +1,466 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/shopspring/decimal"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	configStoragePath = "config"
+
+	defaultEndpoint       = "wss://s.altnet.rippletest.net:51233"
+	defaultNetwork        = "testnet"
+	defaultConnectTimeout = 10 * time.Second
+	defaultRequestTimeout = 30 * time.Second
+
+	transportWebsocket = "websocket"
+	transportJsonRpc   = "jsonrpc"
+
+	networkMainnet = "mainnet"
+	networkTestnet = "testnet"
+	networkDevnet  = "devnet"
+
+	defaultMaxLedgerAge        = 60 * time.Second
+	defaultHealthCheckInterval = 60 * time.Second
+
+	// Networks with an id above this value require the NetworkID field on every transaction,
+	// which the transaction encoder does not support.
+	maxLegacyNetworkId = 1024
+)
+
+// networks are the public networks, whose names are matched whatever their case. Any other name is taken
+// to be a private network.
+var networks = []string{networkMainnet, networkTestnet, networkDevnet}
+
+// Config holds the mount-level settings used to talk to the XRP Ledger
+type Config struct {
+	Transport      string        `json:"transport"`
+	ProxyURL       string        `json:"proxy_url"`
+	Endpoints      []string      `json:"endpoints"`
+	Network        string        `json:"network"`
+	NetworkId      uint32        `json:"network_id"`
+	ConnectTimeout time.Duration `json:"connect_timeout"`
+	RequestTimeout time.Duration `json:"request_timeout"`
+	Offline        bool          `json:"offline"`
+
+	MaxLedgerAge        time.Duration `json:"max_ledger_age"`
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+
+	FundingMode    string `json:"funding_mode"`
+	FaucetURL      string `json:"faucet_url"`
+	FundingAccount string `json:"funding_account"`
+	FundingAmount  string `json:"funding_amount"`
+	BaseReserve    string `json:"base_reserve"`
+	OwnerReserve   string `json:"owner_reserve"`
+}
+
+// defaultConfig returns the settings used when the mount has not been configured
+func defaultConfig() *Config {
+	return &Config{
+		Transport:      transportWebsocket,
+		Endpoints:      []string{defaultEndpoint},
+		Network:        defaultNetwork,
+		ConnectTimeout: defaultConnectTimeout,
+		RequestTimeout: defaultRequestTimeout,
+
+		MaxLedgerAge:        defaultMaxLedgerAge,
+		HealthCheckInterval: defaultHealthCheckInterval,
+
+		FundingMode:   fundingModeFaucet,
+		FaucetURL:     defaultFaucetURL,
+		FundingAmount: defaultFundingAmount,
+		BaseReserve:   defaultBaseReserve,
+		OwnerReserve:  defaultOwnerReserve,
+	}
+}
+
+func configPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:         "config",
+			HelpSynopsis:    "Configure the XRP Ledger network used by this mount",
+			HelpDescription: "Sets the rippled endpoints, network and timeouts used whenever the plugin talks to the ledger.",
+			Fields: map[string]*framework.FieldSchema{
+				"transport": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) How to talk to rippled: 'websocket' (default) or 'jsonrpc' over HTTP.",
+				},
+				"proxy_url": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) HTTP proxy used by the jsonrpc transport. Defaults to the proxy from the environment.",
+				},
+				"endpoints": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The rippled endpoints to connect to, highest priority first.",
+				},
+				"network": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Name of the network the endpoints belong to: mainnet, testnet, devnet or the name of a private network.",
+				},
+				"network_id": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) NetworkID of the chain.",
+				},
+				"connect_timeout": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) Maximum time to wait when connecting to an endpoint.",
+				},
+				"request_timeout": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) Maximum time to wait for a response from an endpoint.",
+				},
+				"offline": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Never contact the ledger when signing; callers must supply the sequence.",
+				},
+				"max_ledger_age": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) Endpoints whose last validated ledger is older than this are considered unhealthy.",
+				},
+				"health_check_interval": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) How often the endpoints are health checked.",
+				},
+				"funding_mode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) How new accounts are funded: 'none', 'faucet' (default) or 'account'.",
+				},
+				"faucet_url": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Faucet used when funding_mode is 'faucet'.",
+				},
+				"funding_account": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Name of the Vault account that pays for new accounts when funding_mode is 'account'.",
+				},
+				"funding_amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Amount of XRP sent to each new account.",
+				},
+				"base_reserve": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Minimum XRP balance required for an account to exist on the ledger.",
+				},
+				"owner_reserve": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) XRP reserve per owned ledger object. Also the fee charged for deleting an account.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathWriteConfig,
+				logical.UpdateOperation: b.pathWriteConfig,
+				logical.ReadOperation:   b.pathReadConfig,
+				logical.DeleteOperation: b.pathDeleteConfig,
+			},
+		},
+	}
+}
+
+// Stores the mount configuration, merging the request into any existing configuration
+func (b *backend) pathWriteConfig(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	transportChanged := false
+	if transportRaw, ok := d.GetOk("transport"); ok {
+		transport := transportRaw.(string)
+		if transport != transportWebsocket && transport != transportJsonRpc {
+			return logical.ErrorResponse(fmt.Sprintf("transport must be '%s' or '%s'", transportWebsocket, transportJsonRpc)), nil
+		}
+		transportChanged = config.Transport != transport
+		config.Transport = transport
+	}
+
+	if proxyURL, ok := d.GetOk("proxy_url"); ok {
+		if _, err := url.Parse(proxyURL.(string)); err != nil {
+			return logical.ErrorResponse("proxy_url is not a valid url"), nil
+		}
+		config.ProxyURL = proxyURL.(string)
+	}
+
+	if endpointsRaw, ok := d.GetOk("endpoints"); ok {
+		var endpoints []string
+		for _, endpoint := range endpointsRaw.([]string) {
+			endpoint = strings.TrimSpace(endpoint)
+			if endpoint == "" {
+				continue
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		if len(endpoints) == 0 {
+			return errMissingField("endpoints"), nil
+		}
+		config.Endpoints = endpoints
+	} else if transportChanged {
+		return logical.ErrorResponse("endpoints must be supplied when changing the transport"), nil
+	}
+
+	for _, endpoint := range config.Endpoints {
+		if err := validateEndpoint(config.Transport, endpoint); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	if network, ok := d.GetOk("network"); ok {
+		config.Network = normalizeNetwork(network.(string))
+		if config.Network == "" {
+			return errMissingField("network"), nil
+		}
+	}
+
+	if networkIdRaw, ok := d.GetOk("network_id"); ok {
+		networkId := networkIdRaw.(int)
+		if networkId < 0 {
+			return logical.ErrorResponse("network_id cannot be negative"), nil
+		}
+		if networkId > maxLegacyNetworkId {
+			return logical.ErrorResponse(fmt.Sprintf("network_id above %d is not supported", maxLegacyNetworkId)), nil
+		}
+		config.NetworkId = uint32(networkId)
+	}
+
+	if connectTimeout, ok := d.GetOk("connect_timeout"); ok {
+		if connectTimeout.(int) <= 0 {
+			return logical.ErrorResponse("connect_timeout must be positive"), nil
+		}
+		config.ConnectTimeout = time.Duration(connectTimeout.(int)) * time.Second
+	}
+
+	if requestTimeout, ok := d.GetOk("request_timeout"); ok {
+		if requestTimeout.(int) <= 0 {
+			return logical.ErrorResponse("request_timeout must be positive"), nil
+		}
+		config.RequestTimeout = time.Duration(requestTimeout.(int)) * time.Second
+	}
+
+	if offline, ok := d.GetOk("offline"); ok {
+		config.Offline = offline.(bool)
+	}
+
+	if maxLedgerAge, ok := d.GetOk("max_ledger_age"); ok {
+		if maxLedgerAge.(int) <= 0 {
+			return logical.ErrorResponse("max_ledger_age must be positive"), nil
+		}
+		config.MaxLedgerAge = time.Duration(maxLedgerAge.(int)) * time.Second
+	}
+
+	if healthCheckInterval, ok := d.GetOk("health_check_interval"); ok {
+		if healthCheckInterval.(int) <= 0 {
+			return logical.ErrorResponse("health_check_interval must be positive"), nil
+		}
+		config.HealthCheckInterval = time.Duration(healthCheckInterval.(int)) * time.Second
+	}
+
+	if fundingMode, ok := d.GetOk("funding_mode"); ok {
+		if !contains(fundingModes, fundingMode.(string)) {
+			return logical.ErrorResponse(fmt.Sprintf("funding_mode must be one of %v", fundingModes)), nil
+		}
+		config.FundingMode = fundingMode.(string)
+	}
+
+	if faucetURL, ok := d.GetOk("faucet_url"); ok {
+		parsedURL, err := url.Parse(faucetURL.(string))
+		if err != nil || parsedURL.Host == "" || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+			return logical.ErrorResponse("faucet_url must be a http:// or https:// url"), nil
+		}
+		config.FaucetURL = faucetURL.(string)
+	}
+
+	if fundingAccount, ok := d.GetOk("funding_account"); ok {
+		config.FundingAccount = fundingAccount.(string)
+	}
+
+	if fundingAmountRaw, ok := d.GetOk("funding_amount"); ok {
+		fundingAmount, err := decimal.NewFromString(fundingAmountRaw.(string))
+		if err != nil || !fundingAmount.IsPositive() {
+			return logical.ErrorResponse("funding_amount must be a positive number"), nil
+		}
+		config.FundingAmount = fundingAmount.String()
+	}
+
+	if baseReserveRaw, ok := d.GetOk("base_reserve"); ok {
+		baseReserve, err := decimal.NewFromString(baseReserveRaw.(string))
+		if err != nil || baseReserve.IsNegative() {
+			return logical.ErrorResponse("base_reserve must be a non-negative number"), nil
+		}
+		config.BaseReserve = baseReserve.String()
+	}
+
+	if ownerReserveRaw, ok := d.GetOk("owner_reserve"); ok {
+		ownerReserve, err := decimal.NewFromString(ownerReserveRaw.(string))
+		if err != nil || ownerReserve.IsNegative() {
+			return logical.ErrorResponse("owner_reserve must be a non-negative number"), nil
+		}
+		config.OwnerReserve = ownerReserve.String()
+	}
+
+	if config.FundingMode == fundingModeAccount && config.FundingAccount == "" {
+		return errMissingField("funding_account"), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(configStoragePath, config)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	b.resetLedgerClient(nil)
+	b.resetEndpointHealth()
+
+	return configResponse(config), nil
+}
+
+// Returns the current mount configuration (or the defaults if none has been written)
+func (b *backend) pathReadConfig(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return configResponse(config), nil
+}
+
+// Removes the mount configuration, reverting to the defaults
+func (b *backend) pathDeleteConfig(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, configStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	b.resetLedgerClient(nil)
+	b.resetEndpointHealth()
+	return nil, nil
+}
+
+// readConfig loads the mount configuration, falling back to the defaults for anything unset
+func (b *backend) readConfig(ctx context.Context, s logical.Storage) (*Config, error) {
+	config := defaultConfig()
+
+	entry, err := s.Get(ctx, configStoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config")
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return config, nil
+	}
+
+	err = entry.DecodeJSON(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize config")
+	}
+	if config.Transport == "" {
+		config.Transport = transportWebsocket
+	}
+	config.Network = normalizeNetwork(config.Network)
+	if len(config.Endpoints) == 0 {
+		config.Endpoints = []string{defaultEndpoint}
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = defaultConnectTimeout
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	if config.MaxLedgerAge <= 0 {
+		config.MaxLedgerAge = defaultMaxLedgerAge
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if config.FundingMode == "" {
+		config.FundingMode = fundingModeFaucet
+	}
+	if config.FaucetURL == "" {
+		config.FaucetURL = defaultFaucetURL
+	}
+	if config.FundingAmount == "" {
+		config.FundingAmount = defaultFundingAmount
+	}
+	if config.BaseReserve == "" {
+		config.BaseReserve = defaultBaseReserve
+	}
+	if config.OwnerReserve == "" {
+		config.OwnerReserve = defaultOwnerReserve
+	}
+
+	return config, nil
+}
+
+// mainnet reports whether the mount is configured for the main network
+func (c *Config) mainnet() bool {
+	return c.Network == networkMainnet
+}
+
+// normalizeNetwork returns the name of a public network in lower case, and the name of any other network as given
+func normalizeNetwork(network string) string {
+	network = strings.TrimSpace(network)
+	for _, known := range networks {
+		if strings.EqualFold(network, known) {
+			return known
+		}
+	}
+	return network
+}
+
+// validateEndpoint checks that the endpoint url matches the transport
+func validateEndpoint(transport string, endpoint string) error {
+	schemes := []string{"ws", "wss"}
+	if transport == transportJsonRpc {
+		schemes = []string{"http", "https"}
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" || !contains(schemes, endpointURL.Scheme) {
+		return fmt.Errorf("endpoint '%s' must be a %s:// or %s:// url for the %s transport", endpoint, schemes[0], schemes[1], transport)
+	}
+	return nil
+}
+
+func configResponse(config *Config) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"transport":       config.Transport,
+			"proxy_url":       config.ProxyURL,
+			"endpoints":       config.Endpoints,
+			"network":         config.Network,
+			"network_id":      config.NetworkId,
+			"connect_timeout": int64(config.ConnectTimeout / time.Second),
+			"request_timeout": int64(config.RequestTimeout / time.Second),
+			"offline":         config.Offline,
+
+			"max_ledger_age":        int64(config.MaxLedgerAge / time.Second),
+			"health_check_interval": int64(config.HealthCheckInterval / time.Second),
+
+			"funding_mode":    config.FundingMode,
+			"faucet_url":      config.FaucetURL,
+			"funding_account": config.FundingAccount,
+			"funding_amount":  config.FundingAmount,
+			"base_reserve":    config.BaseReserve,
+			"owner_reserve":   config.OwnerReserve,
+		},
+	}
+}
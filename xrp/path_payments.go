@@ -22,7 +22,7 @@ import (
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/rubblelabs/ripple/data"
-	"math/big"
+	"github.com/shopspring/decimal"
 	"strings"
 )
 
@@ -32,40 +32,7 @@ func paymentsPaths(b *backend) []*framework.Path {
 		&framework.Path{
 			Pattern:      "payments",
 			HelpSynopsis: "Make a payment on the Ripple network",
-			Fields: map[string]*framework.FieldSchema{
-				"source": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "Source account",
-				},
-				"destination": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "Destination account",
-				},
-				"paymentChannel": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "(Optional) Payment channel account",
-				},
-				"additionalSigners": &framework.FieldSchema{
-					Type:        framework.TypeCommaStringSlice,
-					Description: "(Optional) Array of additional signers for this transaction",
-				},
-				"amount": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "Amount to send",
-				},
-				"assetCode": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "Code of asset to send (use 'native' for XRP)",
-				},
-				"assetIssuer": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "(Optional) If paying with a non-native asset, this is the issuer address",
-				},
-				"memo": &framework.FieldSchema{
-					Type:        framework.TypeString,
-					Description: "(Optional) An optional memo to include with the payment transaction",
-				},
-			},
+			Fields:       paymentFields(),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.createPayment,
 				logical.UpdateOperation: b.createPayment,
@@ -74,8 +41,61 @@ func paymentsPaths(b *backend) []*framework.Path {
 	}
 }
 
+// paymentFields is the schema of payment requests, which is also used to sign payments once they are approved
+func paymentFields() map[string]*framework.FieldSchema {
+	return txOptionFields(map[string]*framework.FieldSchema{
+		"source": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Source account",
+		},
+		"destination": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Destination Vault account name, classic address or X-address",
+		},
+		"paymentChannel": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "(Optional) Payment channel account",
+		},
+		"additionalSigners": &framework.FieldSchema{
+			Type:        framework.TypeCommaStringSlice,
+			Description: "(Optional) Array of additional signers for this transaction",
+		},
+		"amount": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Amount to send",
+		},
+		"assetCode": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Code of asset to send (use 'native' for XRP)",
+		},
+		"assetIssuer": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "(Optional) If paying with a non-native asset, this is the issuer address",
+		},
+		"destination_tag": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: "(Optional) Destination tag identifying the recipient at the destination, e.g. an exchange deposit",
+		},
+		"source_tag": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Description: "(Optional) Source tag identifying the sender on whose behalf the payment is made",
+		},
+		"invoice_id": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "(Optional) 256-bit hash, as 64 hex characters, identifying the reason for the payment",
+		},
+	})
+}
+
 // RIPPLE: Creates a signed transaction with a payment operation.
 func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.signPaymentRequest(ctx, req, d, nil)
+}
+
+// signPaymentRequest signs the payment described by a payments request. Payments above the approval threshold
+// of the source account are held for approval instead, unless they are the approved pending transaction, which
+// is only signed if it still sends the approved amount to the approved destination.
+func (b *backend) signPaymentRequest(ctx context.Context, req *logical.Request, d *framework.FieldData, approved *PendingTransaction) (*logical.Response, error) {
 
 	// Validate we didn't get extra fields
 	err := validateFields(req, d)
@@ -98,7 +118,10 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 	if amountStr == "" {
 		return errMissingField("amount"), nil
 	}
-	amount := validNumber(amountStr)
+	amount, err := decimal.NewFromString(amountStr)
+	if err != nil || !amount.IsPositive() {
+		return logical.ErrorResponse("amount must be a positive number"), nil
+	}
 
 	assetCode := d.Get("assetCode").(string)
 	if assetCode == "" {
@@ -111,15 +134,21 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 		return errMissingField("assetIssuer"), nil
 	}
 
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
 	// Read the optional additionalSigners field
 	//var additionalSigners []string
 	//if additionalSignersRaw, ok := d.GetOk("additionalSigners"); ok {
 	//	additionalSigners = additionalSignersRaw.([]string)
 	//}
 
-	// Read the optional memo field
-	//memo := d.Get("memo").(string)
-
 	// Retrieve the source account keypair from vault storage
 	sourceAccount, err := b.readVaultAccount(ctx, req, "accounts/"+source)
 	if err != nil {
@@ -130,24 +159,69 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 	}
 	sourceAddress := sourceAccount.AccountId
 
-	// Retrieve the destination account keypair from vault storage
-	destinationAccount, err := b.readVaultAccount(ctx, req, "accounts/"+destination)
+	// The destination may be a Vault account or any address on the ledger
+	destinationAddress, destinationTag, err := b.resolveDestination(ctx, req, config, destination)
 	if err != nil {
 		return nil, err
 	}
-	if destinationAccount == nil {
-		return nil, logical.CodedError(400, "destination account not found")
-	}
-	destinationAddress := destinationAccount.AccountId
 
 	// Prepare the payment transaction
 	payment, err := createPaymentTransaction(sourceAddress, destinationAddress, amount.String(), assetCode, assetIssuer)
 	if err != nil {
 		return nil, err
 	}
+	payment.DestinationTag = destinationTag
+
+	// Refuse to sign anything the source account's policy does not allow
+	spend := amountSpend(&payment.Amount, amount)
+	err = b.enforceSpendPolicy(ctx, req.Storage, sourceAccount, destinationAddress, spend)
+	if err != nil {
+		return nil, err
+	}
+
+	if destinationTagRaw, ok := d.GetOk("destination_tag"); ok {
+		tag, err := toUint32(destinationTagRaw.(int))
+		if err != nil {
+			return logical.ErrorResponse("destination_tag " + err.Error()), nil
+		}
+		if destinationTag != nil && *destinationTag != tag {
+			return logical.ErrorResponse("destination_tag does not match the tag in the destination X-address"), nil
+		}
+		payment.DestinationTag = &tag
+	}
+	if sourceTagRaw, ok := d.GetOk("source_tag"); ok {
+		tag, err := toUint32(sourceTagRaw.(int))
+		if err != nil {
+			return logical.ErrorResponse("source_tag " + err.Error()), nil
+		}
+		payment.SourceTag = &tag
+	}
+	if invoiceIdRaw, ok := d.GetOk("invoice_id"); ok {
+		invoiceId, err := parseHash256(invoiceIdRaw.(string))
+		if err != nil {
+			return logical.ErrorResponse("invoice_id must be a 256-bit hash of 64 hex characters"), nil
+		}
+		payment.InvoiceID = invoiceId
+	}
+
+	// Large payments need the approval of other operators before they are signed, and once approved they are only
+	// signed as they were approved
+	if approved == nil && sourceAccount.ApprovalPolicy.requiresApproval(spend) {
+		pending, err := newPendingTransaction(req, pendingKindPayment, req.Data, source, destinationAddress, spend, sourceAccount.ApprovalPolicy)
+		if err != nil {
+			return nil, err
+		}
+		return b.holdForApproval(ctx, req.Storage, pending)
+	}
+	if approved != nil {
+		err = approved.checkApproved(destinationAddress, spend)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Sign the transaction
-	signedPayment, err := signPaymentTransaction(sourceAccount, payment)
+	signedPayment, err := b.signLimitedPayment(ctx, req.Storage, config, sourceAccount, payment, spend, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -157,33 +231,55 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 		return nil, err
 	}
 
-	return &logical.Response{
+	response := &logical.Response{
 		Data: map[string]interface{}{
-			"source_address":     signedPayment.Account.String(),
-			"account_sequence":   signedPayment.Sequence,
-			"fee":                signedPayment.Fee.String(),
-			"transaction_hash":   signedPayment.Hash.String(),
-			"signed_transaction": fmt.Sprintf("%X", txRaw),
+			"source_address":      signedPayment.Account.String(),
+			"destination_address": signedPayment.Destination.String(),
+			"account_sequence":    signedPayment.Sequence,
+			"fee":                 signedPayment.Fee.String(),
+			"transaction_hash":    signedPayment.Hash.String(),
+			"signed_transaction":  fmt.Sprintf("%X", txRaw),
 		},
-	}, nil
+	}
+	if signedPayment.DestinationTag != nil {
+		response.Data["destination_tag"] = *signedPayment.DestinationTag
+	}
+	if signedPayment.SourceTag != nil {
+		response.Data["source_tag"] = *signedPayment.SourceTag
+	}
+	if signedPayment.InvoiceID != nil {
+		response.Data["invoice_id"] = signedPayment.InvoiceID.String()
+	}
+	return response, nil
 }
 
-func (b *backend) validAccountConstraints(account *Account, amount *big.Int, toAddress string) (bool, error) {
-	txLimit := validNumber(account.TxSpendLimit)
-
-	if txLimit.Cmp(amount) == -1 && txLimit.Cmp(big.NewInt(0)) == 1 {
-		return false, fmt.Errorf("transaction amount (%s) is larger than the transactional limit (%s)", amount.String(), account.TxSpendLimit)
+// resolveDestination returns the address of a destination given as a Vault account name, a classic address or an
+// X-address, together with the destination tag embedded in an X-address
+func (b *backend) resolveDestination(ctx context.Context, req *logical.Request, config *Config, destination string) (string, *uint32, error) {
+	destinationAccount, err := b.readVaultAccount(ctx, req, "accounts/"+destination)
+	if err != nil {
+		return "", nil, err
 	}
-
-	if contains(account.Blacklist, toAddress) {
-		return false, fmt.Errorf("%s is blacklisted", toAddress)
+	if destinationAccount != nil {
+		return destinationAccount.AccountId, nil, nil
 	}
 
-	if len(account.Whitelist) > 0 && !contains(account.Whitelist, toAddress) {
-		return false, fmt.Errorf("%s is not in the whitelist", toAddress)
+	if isXAddress(destination) {
+		decoded, err := decodeXAddress(destination)
+		if err != nil {
+			return "", nil, logical.CodedError(400, "invalid destination X-address: "+err.Error())
+		}
+		if decoded.Mainnet != config.mainnet() {
+			return "", nil, logical.CodedError(400, fmt.Sprintf("destination X-address is not for the %s network", config.Network))
+		}
+		return decoded.Account.String(), decoded.Tag, nil
 	}
 
-	return true, nil
+	address, err := data.NewAccountFromAddress(destination)
+	if err != nil {
+		return "", nil, logical.CodedError(400, "destination is neither a Vault account nor a valid address")
+	}
+	return address.String(), nil, nil
 }
 
 // Create a new unsigned payment transaction
@@ -226,7 +322,6 @@ func createPaymentTransaction(sourceAddress string, destinationAddress string, a
 	fee, err := data.NewNativeValue(int64(10))
 	base := payment.GetBase()
 	base.Fee = *fee
-	//base.Memos = new data.Memo{}
 	base.Account = *src
 
 	return payment, nil
@@ -0,0 +1,450 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/rubblelabs/ripple/data"
+	"log"
+	"time"
+)
+
+// asfDisableMaster is the AccountSet flag that stops the master key from signing
+const asfDisableMaster = uint32(4)
+
+// RegularKey is a Vault-held key pair set as the regular key of an account with SetRegularKey
+type RegularKey struct {
+	AccountId   string    `json:"account_id"`
+	PublicKey   string    `json:"public_key"`
+	Secret      string    `json:"secret"`
+	KeyType     string    `json:"key_type"`
+	SetTxHash   string    `json:"set_tx_hash"`
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatedAt time.Time `json:"activated_at"`
+
+	// LastLedgerSequence of the SetRegularKey, if it has one. Past it the transaction can no longer be validated.
+	LastLedgerSequence uint32 `json:"last_ledger_sequence,omitempty"`
+}
+
+// RetiredRegularKey records a regular key replaced by a newer one. The key itself is not kept.
+type RetiredRegularKey struct {
+	AccountId   string    `json:"account_id"`
+	PublicKey   string    `json:"public_key"`
+	KeyType     string    `json:"key_type"`
+	SetTxHash   string    `json:"set_tx_hash"`
+	ActivatedAt time.Time `json:"activated_at"`
+	RetiredAt   time.Time `json:"retired_at"`
+	Signatures  uint64    `json:"signatures"`
+}
+
+func regularKeyPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/regular_key",
+			HelpSynopsis: "Generate a regular key for an account and sign the SetRegularKey transaction.",
+			HelpDescription: "The new key stays pending, and the current key keeps signing, until it is confirmed " +
+				"with accounts/<name>/regular_key/confirm. No other key can be generated while one is pending, unless " +
+				"its SetRegularKey has failed on the ledger or cancel_pending is set.",
+			Fields: txOptionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"key_type": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Type of the regular key, secp256k1 or ed25519",
+					Default:     keyTypeSecp256k1,
+				},
+				"submit": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Submit the SetRegularKey transaction to the ledger.",
+				},
+				"cancel_pending": &framework.FieldSchema{
+					Type: framework.TypeBool,
+					Description: "(Optional) Discard the pending regular key even though its SetRegularKey may still be validated. " +
+						"If it is, the account's regular key is one Vault no longer holds.",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathSetRegularKey,
+				logical.UpdateOperation: b.pathSetRegularKey,
+				logical.ReadOperation:   b.pathReadRegularKey,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/regular_key/confirm",
+			HelpSynopsis: "Start signing with the pending regular key once its SetRegularKey transaction is validated.",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"force": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Activate the key without checking the SetRegularKey transaction on the ledger.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathConfirmRegularKey,
+				logical.UpdateOperation: b.pathConfirmRegularKey,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/disable_master",
+			HelpSynopsis: "Sign an AccountSet transaction disabling the master key of an account.",
+			HelpDescription: "The account must have an active regular key, which signs the transaction. " +
+				"Afterwards only the regular key can sign for the account.",
+			Fields: txOptionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"submit": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Submit the AccountSet transaction to the ledger.",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathDisableMasterKey,
+				logical.UpdateOperation: b.pathDisableMasterKey,
+			},
+		},
+	}
+}
+
+// Generates a new regular key and signs the SetRegularKey transaction with the current key of the account
+func (b *backend) pathSetRegularKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	keyType := d.Get("key_type").(string)
+	if !contains(keyTypes, keyType) {
+		return logical.ErrorResponse(fmt.Sprintf("key_type must be one of %v", keyTypes)), nil
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + name
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+
+	// Discarding a pending key whose SetRegularKey is later validated would lose control of the account
+	if pending := vaultAccount.PendingRegularKey; pending != nil {
+		failed := false
+		if !config.Offline {
+			failed, err = b.txFailed(config, pending.SetTxHash, pending.LastLedgerSequence)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !failed && !d.Get("cancel_pending").(bool) {
+			return logical.ErrorResponse(fmt.Sprintf("regular key %s is pending on SetRegularKey %s; confirm it, "+
+				"or set cancel_pending=true if that transaction will never be validated", pending.AccountId, pending.SetTxHash)), nil
+		}
+		log.Printf("discarding pending regular key %s of account %s", pending.AccountId, vaultAccount.AccountId)
+	}
+
+	regularKey, signedTx, err := b.newRegularKey(ctx, req.Storage, config, vaultAccount, keyType, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the new key pending; the current key signs until the SetRegularKey is confirmed
+	vaultAccount.PendingRegularKey = regularKey
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("generated regular key %s for account %s", regularKey.AccountId, vaultAccount.AccountId)
+
+	response, err := b.signedTxResponse(config, signedTx, d.Get("submit").(bool) && !opts.Offline)
+	if err != nil {
+		return nil, err
+	}
+	response.Data["regular_key"] = regularKey.AccountId
+	response.Data["regular_key_public_key"] = regularKey.PublicKey
+	return response, nil
+}
+
+// newRegularKey generates a regular key of the given type and signs the SetRegularKey transaction
+// assigning it to the account with the current key of the account
+func (b *backend) newRegularKey(ctx context.Context, s logical.Storage, config *Config, account *Account, keyType string, opts *txOptions) (*RegularKey, *data.SetRegularKey, error) {
+	keys, err := generateAccountKeys(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := data.NewAccountFromAddress(account.AccountId)
+	if err != nil {
+		return nil, nil, err
+	}
+	regularKeyId, err := data.NewRegularKeyFromAddress(keys.AccountId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	setRegularKeyTx := &data.SetRegularKey{
+		RegularKey: regularKeyId,
+	}
+	setRegularKeyTx.TransactionType = data.SET_REGULAR_KEY
+	setRegularKeyTx.Flags = new(data.TransactionFlag)
+
+	fee, err := data.NewNativeValue(int64(10))
+	if err != nil {
+		return nil, nil, err
+	}
+	base := setRegularKeyTx.GetBase()
+	base.Fee = *fee
+	base.Account = *src
+
+	signedTx, err := b.signSetRegularKeyTransaction(ctx, s, config, account, setRegularKeyTx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	regularKey := &RegularKey{
+		AccountId: keys.AccountId,
+		PublicKey: keys.PublicKey,
+		Secret:    keys.Secret,
+		KeyType:   keys.KeyType,
+		SetTxHash: signedTx.Hash.String(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if signedTx.LastLedgerSequence != nil {
+		regularKey.LastLedgerSequence = *signedTx.LastLedgerSequence
+	}
+	return regularKey, signedTx, nil
+}
+
+// activatePendingRegularKey makes the pending regular key the signing key of the account. The
+// replaced key is retired into the key history without its secret.
+func (b *backend) activatePendingRegularKey(ctx context.Context, s logical.Storage, account *Account) error {
+	now := time.Now().UTC()
+	if previous := account.RegularKey; previous != nil {
+		usage, err := b.readKeyUsage(ctx, s, previous.AccountId)
+		if err != nil {
+			return err
+		}
+		account.RegularKeyHistory = append(account.RegularKeyHistory, &RetiredRegularKey{
+			AccountId:   previous.AccountId,
+			PublicKey:   previous.PublicKey,
+			KeyType:     previous.KeyType,
+			SetTxHash:   previous.SetTxHash,
+			ActivatedAt: previous.ActivatedAt,
+			RetiredAt:   now,
+			Signatures:  usage.Signatures,
+		})
+		err = s.Delete(ctx, keyUsageStoragePrefix+previous.AccountId)
+		if err != nil {
+			return err
+		}
+	}
+
+	account.RegularKey = account.PendingRegularKey
+	account.RegularKey.ActivatedAt = now
+	account.PendingRegularKey = nil
+	return nil
+}
+
+// Returns the active and pending regular keys of an account
+func (b *backend) pathReadRegularKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	vaultAccount, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, nil
+	}
+
+	response := &logical.Response{
+		Data: map[string]interface{}{
+			"master_disabled": vaultAccount.DisableMasterTxHash != "",
+		},
+	}
+	if vaultAccount.RegularKey != nil {
+		response.Data["regular_key"] = vaultAccount.RegularKey.AccountId
+		response.Data["regular_key_public_key"] = vaultAccount.RegularKey.PublicKey
+		response.Data["set_transaction_hash"] = vaultAccount.RegularKey.SetTxHash
+	}
+	if vaultAccount.PendingRegularKey != nil {
+		response.Data["pending_regular_key"] = vaultAccount.PendingRegularKey.AccountId
+		response.Data["pending_set_transaction_hash"] = vaultAccount.PendingRegularKey.SetTxHash
+	}
+	if vaultAccount.DisableMasterTxHash != "" {
+		response.Data["disable_master_transaction_hash"] = vaultAccount.DisableMasterTxHash
+	}
+	if len(vaultAccount.RegularKeyHistory) > 0 {
+		response.Data["history"] = vaultAccount.RegularKeyHistory
+	}
+	return response, nil
+}
+
+// Activates the pending regular key. Its SetRegularKey transaction must have been validated unless force is set.
+func (b *backend) pathConfirmRegularKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + d.Get("name").(string)
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+	pending := vaultAccount.PendingRegularKey
+	if pending == nil {
+		return logical.ErrorResponse("no regular key is pending"), nil
+	}
+
+	if !d.Get("force").(bool) {
+		config, err := b.readConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if config.Offline {
+			return logical.ErrorResponse("cannot verify the SetRegularKey transaction on an offline mount, use force=true"), nil
+		}
+		err = b.txValidated(config, pending.SetTxHash)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("SetRegularKey %s", err)), nil
+		}
+	}
+
+	err = b.activatePendingRegularKey(ctx, req.Storage, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("regular key %s is now active for account %s", pending.AccountId, vaultAccount.AccountId)
+
+	return b.pathReadRegularKey(ctx, req, d)
+}
+
+// Signs an AccountSet asfDisableMaster transaction with the active regular key
+func (b *backend) pathDisableMasterKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readTxOptions(config, d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + d.Get("name").(string)
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+	if vaultAccount.RegularKey == nil {
+		return logical.ErrorResponse("the account needs an active regular key before the master key can be disabled"), nil
+	}
+	// Until the pending SetRegularKey settles, the active key may not be the one the ledger accepts
+	if vaultAccount.PendingRegularKey != nil {
+		return logical.ErrorResponse("a regular key rotation is pending; confirm or replace it before disabling the master key"), nil
+	}
+	src, err := data.NewAccountFromAddress(vaultAccount.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	disableMaster := asfDisableMaster
+	accountSetTx := &data.AccountSet{
+		SetFlag: &disableMaster,
+	}
+	accountSetTx.TransactionType = data.ACCOUNT_SET
+	accountSetTx.Flags = new(data.TransactionFlag)
+
+	fee, err := data.NewNativeValue(int64(10))
+	if err != nil {
+		return nil, err
+	}
+	base := accountSetTx.GetBase()
+	base.Fee = *fee
+	base.Account = *src
+
+	signedTx, err := b.signAccountSetTransaction(ctx, req.Storage, config, vaultAccount, accountSetTx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultAccount.DisableMasterTxHash = signedTx.Hash.String()
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.signedTxResponse(config, signedTx, d.Get("submit").(bool) && !opts.Offline)
+}
+
+// signedTxResponse describes a signed transaction, submitting it to the ledger first if requested
+func (b *backend) signedTxResponse(config *Config, signedTx data.Transaction, submit bool) (*logical.Response, error) {
+	_, txRaw, err := data.Raw(signedTx)
+	if err != nil {
+		return nil, err
+	}
+	base := signedTx.GetBase()
+
+	response := &logical.Response{
+		Data: map[string]interface{}{
+			"source_address":     base.Account.String(),
+			"account_sequence":   base.Sequence,
+			"fee":                base.Fee.String(),
+			"transaction_hash":   base.Hash.String(),
+			"signed_transaction": fmt.Sprintf("%X", txRaw),
+			"submitted":          false,
+		},
+	}
+
+	if submit {
+		submitResult, err := b.ledger(config).Submit(signedTx)
+		if err != nil {
+			return nil, err
+		}
+		response.Data["engine_result"] = submitResult.EngineResult
+		response.Data["submitted"] = submitSucceeded(submitResult)
+		if !submitSucceeded(submitResult) {
+			response.AddWarning(fmt.Sprintf("%s was not applied: %s -- %s", base.TransactionType, submitResult.EngineResult, submitResult.EngineResultMessage))
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,401 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/rubblelabs/ripple/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/tyler-smith/go-bip32"
+	"github.com/tyler-smith/go-bip39"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	bip44Purpose  = 44
+	bip44CoinType = 144
+
+	walletStoragePrefix      = "wallets/"
+	walletChildStoragePrefix = "wallet_children/"
+	defaultMnemonicWords     = 24
+)
+
+// Wallet is the root of a BIP44 hierarchy of accounts, derived at m/44'/144'/account'/0/index.
+// The keys of derived accounts are never stored; they are re-derived from the mnemonic when signing.
+type Wallet struct {
+	Mnemonic   string `json:"mnemonic"`
+	Passphrase string `json:"passphrase"`
+	Account    uint32 `json:"account"`
+	NextIndex  uint32 `json:"next_index"`
+}
+
+// walletChild records which Vault account holds a derived index
+type walletChild struct {
+	AccountName string `json:"account_name"`
+}
+
+func walletsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "wallets/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathListWallets,
+			},
+		},
+		&framework.Path{
+			Pattern:      "wallets/" + framework.GenericNameRegex("name"),
+			HelpSynopsis: "Create a hierarchical deterministic wallet from a BIP39 mnemonic",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"mnemonic": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) BIP39 mnemonic to import. A new one is generated if not given.",
+				},
+				"passphrase": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) BIP39 passphrase",
+				},
+				"words": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Number of words of a generated mnemonic: 12, 15, 18, 21 or 24",
+					Default:     defaultMnemonicWords,
+				},
+				"account_index": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) BIP44 account of the wallet, the account' level of m/44'/144'/account'/0/index",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathCreateWallet,
+				logical.UpdateOperation: b.pathCreateWallet,
+				logical.ReadOperation:   b.pathReadWallet,
+				logical.DeleteOperation: b.pathDeleteWallet,
+			},
+		},
+		&framework.Path{
+			Pattern:      "wallets/" + framework.GenericNameRegex("name") + "/derive",
+			HelpSynopsis: "Derive a child account of the wallet",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"account_name": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Name of the Vault account the child is stored as",
+				},
+				"index": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Index of the child. Defaults to the next unused index.",
+				},
+				"tx_spend_limit": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum amount of tokens which can be sent in a single transaction",
+					Default:     "0",
+				},
+				"whitelist": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of accounts that this account can transact with.",
+				},
+				"blacklist": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of accounts that this account is forbidden from transacting with.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathDeriveWalletAccount,
+				logical.UpdateOperation: b.pathDeriveWalletAccount,
+			},
+		},
+	}
+}
+
+// Returns a list of stored wallets
+func (b *backend) pathListWallets(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	wallets, err := req.Storage.List(ctx, walletStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(wallets), nil
+}
+
+// Stores a new wallet, either from the given mnemonic or a newly generated one. The mnemonic is never returned.
+func (b *backend) pathCreateWallet(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.walletLock.Lock()
+	defer b.walletLock.Unlock()
+
+	existing, err := b.readWallet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return logical.ErrorResponse(fmt.Sprintf("wallet %s already exists", name)), nil
+	}
+
+	account, err := toUint32(d.Get("account_index").(int))
+	if err != nil || account >= bip32.FirstHardenedChild {
+		return logical.ErrorResponse(fmt.Sprintf("account_index must be between 0 and %d", bip32.FirstHardenedChild-1)), nil
+	}
+
+	mnemonic := strings.Join(strings.Fields(d.Get("mnemonic").(string)), " ")
+	if mnemonic == "" {
+		words := d.Get("words").(int)
+		if words < 12 || words > 24 || words%3 != 0 {
+			return logical.ErrorResponse("words must be one of 12, 15, 18, 21 or 24"), nil
+		}
+		entropy, err := bip39.NewEntropy(words / 3 * 32)
+		if err != nil {
+			return nil, err
+		}
+		mnemonic, err = bip39.NewMnemonic(entropy)
+		if err != nil {
+			return nil, err
+		}
+	} else if !bip39.IsMnemonicValid(mnemonic) {
+		return logical.ErrorResponse("mnemonic is not a valid BIP39 mnemonic"), nil
+	}
+
+	wallet := &Wallet{
+		Mnemonic:   mnemonic,
+		Passphrase: d.Get("passphrase").(string),
+		Account:    account,
+	}
+	err = b.writeWallet(ctx, req.Storage, name, wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("successfully created wallet %s", name)
+
+	return walletResponse(wallet), nil
+}
+
+// Returns the wallet details, without the mnemonic
+func (b *backend) pathReadWallet(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	wallet, err := b.readWallet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if wallet == nil {
+		return nil, nil
+	}
+	return walletResponse(wallet), nil
+}
+
+// Deletes a wallet. Refused while accounts derived from it are still stored, since they could no longer sign.
+func (b *backend) pathDeleteWallet(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.walletLock.Lock()
+	defer b.walletLock.Unlock()
+
+	indexes, err := req.Storage.List(ctx, walletChildStoragePrefix+name+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		entry, err := req.Storage.Get(ctx, walletChildStoragePrefix+name+"/"+index)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		var child walletChild
+		if err := entry.DecodeJSON(&child); err != nil {
+			return nil, err
+		}
+		account, err := b.readVaultAccount(ctx, req, "accounts/"+child.AccountName)
+		if err != nil {
+			return nil, err
+		}
+		if account != nil && account.Wallet == name {
+			return logical.ErrorResponse(fmt.Sprintf("account %s is still derived from wallet %s", child.AccountName, name)), nil
+		}
+		if err := req.Storage.Delete(ctx, walletChildStoragePrefix+name+"/"+index); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, req.Storage.Delete(ctx, walletStoragePrefix+name)
+}
+
+// Derives the child at the requested (or next unused) index and stores it as a Vault account
+func (b *backend) pathDeriveWalletAccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	accountName := d.Get("account_name").(string)
+	if accountName == "" {
+		return errMissingField("account_name"), nil
+	}
+
+	txSpendLimit, err := decimal.NewFromString(d.Get("tx_spend_limit").(string))
+	if err != nil || txSpendLimit.IsNegative() {
+		return logical.ErrorResponse("tx_spend_limit is either not a number or is negative"), nil
+	}
+
+	b.walletLock.Lock()
+	defer b.walletLock.Unlock()
+
+	wallet, err := b.readWallet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if wallet == nil {
+		return nil, logical.CodedError(404, "wallet not found")
+	}
+
+	index := wallet.NextIndex
+	if indexRaw, ok := d.GetOk("index"); ok {
+		index, err = toUint32(indexRaw.(int))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("index %s", err)), nil
+		}
+	}
+	if index >= bip32.FirstHardenedChild {
+		return logical.ErrorResponse(fmt.Sprintf("index must be below %d", bip32.FirstHardenedChild)), nil
+	}
+
+	childPath := walletChildStoragePrefix + name + "/" + strconv.FormatUint(uint64(index), 10)
+	entry, err := req.Storage.Get(ctx, childPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return logical.ErrorResponse(fmt.Sprintf("index %d of wallet %s has already been derived", index, name)), nil
+	}
+	entry, err = req.Storage.Get(ctx, "accounts/"+accountName)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return logical.ErrorResponse(fmt.Sprintf("account %s already exists", accountName)), nil
+	}
+
+	key, err := wallet.deriveKey(index)
+	if err != nil {
+		return nil, err
+	}
+	account, err := accountFromKey(key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the wallet and index are kept; the key is re-derived when signing
+	account.PrivateKey = ""
+	account.Wallet = name
+	account.WalletIndex = index
+	account.TxSpendLimit = txSpendLimit.String()
+	if whitelistRaw, ok := d.GetOk("whitelist"); ok {
+		account.Whitelist = whitelistRaw.([]string)
+	}
+	if blacklistRaw, ok := d.GetOk("blacklist"); ok {
+		account.Blacklist = blacklistRaw.([]string)
+	}
+
+	err = b.writeVaultAccount(ctx, req, "accounts/"+accountName, account)
+	if err != nil {
+		return nil, err
+	}
+	entry, err = logical.StorageEntryJSON(childPath, &walletChild{AccountName: accountName})
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	if index >= wallet.NextIndex {
+		wallet.NextIndex = index + 1
+		err = b.writeWallet(ctx, req.Storage, name, wallet)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("derived account %v from wallet %s at index %d", account.AccountId, name, index)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"accountId":      account.AccountId,
+			"publicKey":      account.PublicKey,
+			"keyType":        account.KeyType,
+			"txSpendLimit":   account.TxSpendLimit,
+			"whitelist":      account.Whitelist,
+			"blacklist":      account.Blacklist,
+			"wallet":         name,
+			"walletIndex":    index,
+			"derivationPath": wallet.derivationPath(index),
+		},
+	}, nil
+}
+
+// deriveKey derives the secp256k1 key at m/44'/144'/account'/0/index
+func (w *Wallet) deriveKey(index uint32) (crypto.Key, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(w.Mnemonic, w.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := bip32.NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	path := []uint32{
+		bip32.FirstHardenedChild + bip44Purpose,
+		bip32.FirstHardenedChild + bip44CoinType,
+		bip32.FirstHardenedChild + w.Account,
+		0,
+		index,
+	}
+	for _, childIndex := range path {
+		key, err = key.NewChildKey(childIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parsePrivateKey(key.Key)
+}
+
+func (w *Wallet) derivationPath(index uint32) string {
+	return fmt.Sprintf("m/%d'/%d'/%d'/0/%d", bip44Purpose, bip44CoinType, w.Account, index)
+}
+
+func walletResponse(wallet *Wallet) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"derivationPath": fmt.Sprintf("m/%d'/%d'/%d'/0", bip44Purpose, bip44CoinType, wallet.Account),
+			"nextIndex":      wallet.NextIndex,
+		},
+	}
+}
+
+func (b *backend) readWallet(ctx context.Context, s logical.Storage, name string) (*Wallet, error) {
+	var wallet Wallet
+	found, err := b.getEncrypted(ctx, s, walletStoragePrefix+name, &wallet)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+func (b *backend) writeWallet(ctx context.Context, s logical.Storage, name string, wallet *Wallet) error {
+	return b.putEncrypted(ctx, s, walletStoragePrefix+name, wallet)
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"log"
+	"time"
+)
+
+const (
+	// keyUsageStoragePrefix holds the number of signatures made by each regular key
+	keyUsageStoragePrefix = "key_usage/"
+
+	// rotatingAccountsStoragePrefix lists the accounts with a rotation policy, so the periodic job
+	// does not have to read every account
+	rotatingAccountsStoragePrefix = "rotating_accounts/"
+
+	// Rotation SetRegularKey transactions expire this many ledgers after the last validated one. A
+	// rotation is only abandoned, and retried, once its transaction has expired or failed.
+	rotationLedgerWindow = 20
+)
+
+// RotationPolicy rotates the regular key of an account once it is older than Period or has made
+// MaxSignatures signatures. A zero value disables the corresponding trigger.
+type RotationPolicy struct {
+	Period        time.Duration `json:"period"`
+	MaxSignatures uint64        `json:"max_signatures"`
+}
+
+// keyUsage counts the signatures made by a regular key
+type keyUsage struct {
+	Signatures uint64 `json:"signatures"`
+}
+
+func rotationPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/rotation",
+			HelpSynopsis: "Configure automatic rotation of the regular key of an account.",
+			HelpDescription: "When the active regular key is older than period, or has signed max_signatures transactions, " +
+				"a new key is generated and a SetRegularKey transaction signed with the old key is submitted. " +
+				"The old key is retired once the transaction is validated.",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"period": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) Maximum age of a regular key, e.g. 720h",
+				},
+				"max_signatures": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Maximum number of transactions signed with a regular key",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathWriteRotationPolicy,
+				logical.UpdateOperation: b.pathWriteRotationPolicy,
+				logical.ReadOperation:   b.pathReadRotationPolicy,
+				logical.DeleteOperation: b.pathDeleteRotationPolicy,
+			},
+		},
+	}
+}
+
+// Sets the rotation policy of an account
+func (b *backend) pathWriteRotationPolicy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	period := time.Duration(d.Get("period").(int)) * time.Second
+	maxSignatures := d.Get("max_signatures").(int)
+	if period < 0 || maxSignatures < 0 {
+		return logical.ErrorResponse("period and max_signatures cannot be negative"), nil
+	}
+	if period == 0 && maxSignatures == 0 {
+		return logical.ErrorResponse("one of period or max_signatures is required"), nil
+	}
+
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + name
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+	if vaultAccount.RegularKey == nil {
+		return logical.ErrorResponse("the account needs an active regular key before it can be rotated"), nil
+	}
+
+	vaultAccount.RotationPolicy = &RotationPolicy{
+		Period:        period,
+		MaxSignatures: uint64(maxSignatures),
+	}
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(ctx, &logical.StorageEntry{Key: rotatingAccountsStoragePrefix + name})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.pathReadRotationPolicy(ctx, req, d)
+}
+
+// Returns the rotation policy of an account and the usage of its current regular key
+func (b *backend) pathReadRotationPolicy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	vaultAccount, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil || vaultAccount.RotationPolicy == nil {
+		return nil, nil
+	}
+
+	response := &logical.Response{
+		Data: map[string]interface{}{
+			"period":         int64(vaultAccount.RotationPolicy.Period / time.Second),
+			"max_signatures": vaultAccount.RotationPolicy.MaxSignatures,
+		},
+	}
+	if vaultAccount.RegularKey != nil {
+		usage, err := b.readKeyUsage(ctx, req.Storage, vaultAccount.RegularKey.AccountId)
+		if err != nil {
+			return nil, err
+		}
+		response.Data["regular_key"] = vaultAccount.RegularKey.AccountId
+		response.Data["regular_key_activated_at"] = vaultAccount.RegularKey.ActivatedAt
+		response.Data["regular_key_signatures"] = usage.Signatures
+	}
+	if vaultAccount.PendingRegularKey != nil {
+		response.Data["pending_regular_key"] = vaultAccount.PendingRegularKey.AccountId
+	}
+	return response, nil
+}
+
+// Stops rotating the regular key of an account. The active key is kept.
+func (b *backend) pathDeleteRotationPolicy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	name := d.Get("name").(string)
+	path := "accounts/" + name
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount != nil && vaultAccount.RotationPolicy != nil {
+		vaultAccount.RotationPolicy = nil
+		err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, req.Storage.Delete(ctx, rotatingAccountsStoragePrefix+name)
+}
+
+// rotateRegularKeys is run periodically. It activates rotations whose SetRegularKey has been
+// validated and starts a rotation for every account whose regular key is due.
+func (b *backend) rotateRegularKeys(ctx context.Context, req *logical.Request, config *Config) error {
+	names, err := req.Storage.List(ctx, rotatingAccountsStoragePrefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err := b.rotateRegularKey(ctx, req, config, name)
+		if err != nil {
+			// Keep going so one broken account does not hold up the others
+			log.Printf("failed to rotate the regular key of account %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (b *backend) rotateRegularKey(ctx context.Context, req *logical.Request, config *Config, name string) error {
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + name
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return err
+	}
+	if vaultAccount == nil || vaultAccount.RotationPolicy == nil {
+		return req.Storage.Delete(ctx, rotatingAccountsStoragePrefix+name)
+	}
+	if vaultAccount.RegularKey == nil {
+		return fmt.Errorf("no active regular key")
+	}
+
+	// Finish a rotation in progress. The pending key is kept for as long as its SetRegularKey may still be validated.
+	if pending := vaultAccount.PendingRegularKey; pending != nil {
+		failed, err := b.txFailed(config, pending.SetTxHash, pending.LastLedgerSequence)
+		if err != nil {
+			return err
+		}
+		if failed {
+			log.Printf("abandoning regular key %s of account %s: SetRegularKey %s failed", pending.AccountId, name, pending.SetTxHash)
+			vaultAccount.PendingRegularKey = nil
+			return b.writeVaultAccount(ctx, req, path, vaultAccount)
+		}
+		if b.txValidated(config, pending.SetTxHash) != nil {
+			return nil
+		}
+
+		err = b.activatePendingRegularKey(ctx, req.Storage, vaultAccount)
+		if err != nil {
+			return err
+		}
+		log.Printf("rotated the regular key of account %s to %s", name, vaultAccount.RegularKey.AccountId)
+		return b.writeVaultAccount(ctx, req, path, vaultAccount)
+	}
+
+	due, err := b.rotationDue(ctx, req.Storage, vaultAccount)
+	if err != nil || !due {
+		return err
+	}
+
+	// Start a new rotation, signed with the current regular key. The SetRegularKey gets a LastLedgerSequence
+	// so that its failure can be proven, and the new key is stored before it is submitted.
+	serverInfo, err := b.ledger(config).ServerInfo()
+	if err != nil {
+		return err
+	}
+	lastLedgerSequence := serverInfo.ValidatedLedgerSequence + rotationLedgerWindow
+	opts := &txOptions{LastLedgerSequence: &lastLedgerSequence}
+	regularKey, signedTx, err := b.newRegularKey(ctx, req.Storage, config, vaultAccount, vaultAccount.RegularKey.KeyType, opts)
+	if err != nil {
+		return err
+	}
+	vaultAccount.PendingRegularKey = regularKey
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return err
+	}
+
+	submitResult, err := b.ledger(config).Submit(signedTx)
+	if err != nil {
+		return err
+	}
+	if !submitSucceeded(submitResult) {
+		return fmt.Errorf("SetRegularKey was not applied: %s -- %s", submitResult.EngineResult, submitResult.EngineResultMessage)
+	}
+	return nil
+}
+
+// rotationDue reports whether the active regular key has reached the limits of the rotation policy
+func (b *backend) rotationDue(ctx context.Context, s logical.Storage, account *Account) (bool, error) {
+	policy := account.RotationPolicy
+	if policy.Period > 0 && time.Since(account.RegularKey.ActivatedAt) >= policy.Period {
+		return true, nil
+	}
+	if policy.MaxSignatures > 0 {
+		usage, err := b.readKeyUsage(ctx, s, account.RegularKey.AccountId)
+		if err != nil {
+			return false, err
+		}
+		return usage.Signatures >= policy.MaxSignatures, nil
+	}
+	return false, nil
+}
+
+func (b *backend) readKeyUsage(ctx context.Context, s logical.Storage, keyId string) (*keyUsage, error) {
+	entry, err := s.Get(ctx, keyUsageStoragePrefix+keyId)
+	if err != nil {
+		return nil, err
+	}
+	usage := &keyUsage{}
+	if entry != nil {
+		err = entry.DecodeJSON(usage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// recordKeyUsage counts a signature made by the regular key
+func (b *backend) recordKeyUsage(ctx context.Context, s logical.Storage, keyId string) error {
+	b.keyUsageLock.Lock()
+	defer b.keyUsageLock.Unlock()
+
+	usage, err := b.readKeyUsage(ctx, s, keyId)
+	if err != nil {
+		return err
+	}
+	usage.Signatures++
+	entry, err := logical.StorageEntryJSON(keyUsageStoragePrefix+keyId, usage)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRFC1751_vectors(t *testing.T) {
+	tests := []struct {
+		key   string
+		words string
+	}{
+		// The RFC1751 test vectors, reversed to rippled's byte order
+		{"CCAC2AED591056BE4F90FD441C534766", "RASH BUSH MILK LOOK BAD BRIM AVID GAFF BAIT ROT POD LOVE"},
+		{"EFF81F9BFBC65350920CDD7416DE8009", "TROD MUTE TAIL WARM CHAR KONG HAAG CITY BORE O TEAL AWL"},
+	}
+	for _, test := range tests {
+		key, _ := hex.DecodeString(test.key)
+		key = reverseBytes(key)
+
+		words, err := rfc1751WordsFromSeed(key)
+		if err != nil {
+			t.Fatalf("failed to encode %s: %v", test.key, err)
+		}
+		if words != test.words {
+			t.Fatalf("expected %q, got %q", test.words, words)
+		}
+
+		seed, err := rfc1751SeedFromWords(strings.ToLower(test.words))
+		if err != nil {
+			t.Fatalf("failed to decode %q: %v", test.words, err)
+		}
+		if hex.EncodeToString(seed) != hex.EncodeToString(key) {
+			t.Fatalf("expected %x, got %x", key, seed)
+		}
+	}
+}
+
+func TestRFC1751_genesisSeed(t *testing.T) {
+	seed, err := rfc1751SeedFromWords("I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS DARE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ToUpper(hex.EncodeToString(seed)) != "DEDCE9CE67B451D852FD4E846FCDE31C" {
+		t.Fatalf("unexpected seed %X", seed)
+	}
+}
+
+func TestRFC1751_invalid(t *testing.T) {
+	tests := []string{
+		"I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS",
+		"I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS DARK",
+		"I IRE BOND BOW TRIO LAID SEAT GOAL HEN IBIS IBIS XYZZY",
+	}
+	for _, test := range tests {
+		if _, err := rfc1751SeedFromWords(test); err == nil {
+			t.Fatalf("expected %q to be rejected", test)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/shopspring/decimal"
+	"strings"
+)
+
+const nativeCurrency = "XRP"
+
+// spendAmount is an amount leaving an account, in XRP or in an issued currency
+type spendAmount struct {
+	Currency string
+	Issuer   string
+	Value    decimal.Decimal
+}
+
+func nativeSpend(value decimal.Decimal) *spendAmount {
+	return &spendAmount{Currency: nativeCurrency, Value: value}
+}
+
+// amountSpend returns the spend of value in the currency of a ledger amount. The currency and issuer are taken
+// from the parsed amount, so a standard code and its hex form end up with the same limit key.
+func amountSpend(amount *data.Amount, value decimal.Decimal) *spendAmount {
+	if amount.IsNative() {
+		return nativeSpend(value)
+	}
+	return &spendAmount{Currency: amount.Currency.String(), Issuer: amount.Issuer.String(), Value: value}
+}
+
+func (a *spendAmount) native() bool {
+	return a.Currency == nativeCurrency && a.Issuer == ""
+}
+
+// limitKey returns the key of the currency in an account's currency spend limits
+func (a *spendAmount) limitKey() string {
+	if a.native() {
+		return nativeCurrency
+	}
+	return a.Currency + "/" + a.Issuer
+}
+
+func (a *spendAmount) String() string {
+	if a.native() {
+		return a.Value.String() + " XRP"
+	}
+	return a.Value.String() + " " + a.Currency + "/" + a.Issuer
+}
+
+// errPolicyDenied is returned when an account's spend policy forbids signing a transaction
+func errPolicyDenied(format string, args ...interface{}) error {
+	return logical.CodedError(403, "signing denied by account policy: "+fmt.Sprintf(format, args...))
+}
+
+// enforceSpendPolicy refuses a transaction sending amount to destination if the destination or the issuer of
+// the amount is on the mount denylist, or if the account's own policy does not allow it
+func (b *backend) enforceSpendPolicy(ctx context.Context, s logical.Storage, account *Account, destination string, amount *spendAmount) error {
+	err := b.checkDenylist(ctx, s, destination)
+	if err != nil {
+		return err
+	}
+	if amount != nil && !amount.native() {
+		err = b.checkDenylist(ctx, s, amount.Issuer)
+		if err != nil {
+			return err
+		}
+	}
+	return checkSpendPolicy(account, destination, amount)
+}
+
+// checkSpendPolicy enforces the account's blacklist, whitelist and transaction spend limit on a transaction
+// sending amount to destination. The spend limit is in XRP and only applies to XRP amounts. A nil amount
+// checks the destination only.
+func checkSpendPolicy(account *Account, destination string, amount *spendAmount) error {
+	for _, address := range account.Blacklist {
+		if normalizeAddress(address) == destination {
+			return errPolicyDenied("%s is blacklisted", destination)
+		}
+	}
+
+	if len(account.Whitelist) > 0 {
+		whitelisted := false
+		for _, address := range account.Whitelist {
+			if normalizeAddress(address) == destination {
+				whitelisted = true
+				break
+			}
+		}
+		if !whitelisted {
+			return errPolicyDenied("%s is not in the whitelist", destination)
+		}
+	}
+
+	if amount != nil && amount.native() && account.TxSpendLimit != "" {
+		txLimit, err := decimal.NewFromString(account.TxSpendLimit)
+		if err != nil {
+			return fmt.Errorf("invalid tx_spend_limit '%s' on account %s", account.TxSpendLimit, account.AccountId)
+		}
+		if txLimit.IsPositive() && amount.Value.GreaterThan(txLimit) {
+			return errPolicyDenied("transaction amount (%s) is larger than the transactional limit (%s XRP)", amount, txLimit)
+		}
+	}
+
+	if amount != nil {
+		if currencyLimit, ok := account.CurrencySpendLimits[amount.limitKey()]; ok {
+			limit, err := decimal.NewFromString(currencyLimit)
+			if err != nil {
+				return fmt.Errorf("invalid currency spend limit '%s' for %s on account %s", currencyLimit, amount.limitKey(), account.AccountId)
+			}
+			if amount.Value.GreaterThan(limit) {
+				return errPolicyDenied("transaction amount (%s) is larger than the transactional limit for %s (%s)", amount, amount.limitKey(), limit)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseCurrencySpendLimits validates per-currency spend limits keyed by "XRP" or "<currency>/<issuer>"
+// and returns them with normalized keys and amounts
+func parseCurrencySpendLimits(raw map[string]interface{}) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	limits := make(map[string]string, len(raw))
+	for key, value := range raw {
+		normalizedKey, err := normalizeLimitKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		var limit decimal.Decimal
+		switch v := value.(type) {
+		case string:
+			limit, err = decimal.NewFromString(v)
+		case float64:
+			limit = decimal.NewFromFloat(v)
+		case json.Number:
+			limit, err = decimal.NewFromString(v.String())
+		default:
+			err = fmt.Errorf("not a number")
+		}
+		if err != nil || !limit.IsPositive() {
+			return nil, fmt.Errorf("currency spend limit for '%s' must be a positive number", key)
+		}
+		if _, ok := limits[normalizedKey]; ok {
+			return nil, fmt.Errorf("currency spend limit for '%s' is given more than once", normalizedKey)
+		}
+		limits[normalizedKey] = limit.String()
+	}
+	return limits, nil
+}
+
+// normalizeLimitKey returns a key of the form "XRP" or "<currency>/<issuer>" as limitKey builds it for a spend
+// in that currency: the currency code as the ledger reads it, which is case-sensitive, and the classic issuer address
+func normalizeLimitKey(key string) (string, error) {
+	if strings.EqualFold(key, nativeCurrency) {
+		return nativeCurrency, nil
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || !validCurrencyCode(parts[0]) {
+		return "", fmt.Errorf("currency spend limit '%s' must be keyed by XRP or <currency>/<issuer>", key)
+	}
+	currency, err := data.NewCurrency(parts[0])
+	if err != nil || currency.IsNative() {
+		return "", fmt.Errorf("currency spend limit '%s' has an invalid currency code", key)
+	}
+	issuer, err := data.NewAccountFromAddress(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("currency spend limit '%s' has an invalid issuer", key)
+	}
+	return currency.String() + "/" + issuer.String(), nil
+}
+
+// validCurrencyCode reports whether code is a standard three character currency code other than XRP, or a
+// 160-bit nonstandard code in hex
+func validCurrencyCode(code string) bool {
+	if len(code) == 40 {
+		_, err := hex.DecodeString(code)
+		return err == nil
+	}
+	return len(code) == 3 && !strings.EqualFold(code, nativeCurrency)
+}
+
+// normalizeAddress returns the classic address of an X-address, and any other address as it is
+func normalizeAddress(address string) string {
+	if isXAddress(address) {
+		decoded, err := decodeXAddress(address)
+		if err == nil {
+			return decoded.Account.String()
+		}
+	}
+	return address
+}
@@ -17,121 +17,286 @@
 package xrp
 
 import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
 	"github.com/rubblelabs/ripple/crypto"
 	"github.com/rubblelabs/ripple/data"
-	"github.com/rubblelabs/ripple/websockets"
+	"strconv"
 )
 
-// Sign a payment transaction
-func signPaymentTransaction(account *Account, paymentTx *data.Payment) (*data.Payment, error) {
-	// Get the signer key and sequence
-	seed, err := crypto.NewRippleHashCheck(account.Secret, crypto.RIPPLE_FAMILY_SEED)
-	if err != nil {
-		return nil, err
+// txOptions holds the caller-supplied values used when signing a transaction. When offline
+// is set the sequence must be supplied, since no connection to the ledger is made.
+type txOptions struct {
+	Offline            bool
+	Sequence           *uint32
+	Fee                *data.Value
+	LastLedgerSequence *uint32
+	Memos              data.Memos
+}
+
+// txOptionFields adds the fields common to every signing path to the given schema
+func txOptionFields(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	fields["offline"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: "(Optional) Sign without contacting the ledger. Requires 'sequence'.",
+	}
+	fields["sequence"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Account sequence to sign with, instead of looking it up on the ledger.",
+	}
+	fields["fee"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "(Optional) Transaction fee in drops.",
+	}
+	fields["last_ledger_sequence"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Highest ledger index this transaction can appear in.",
 	}
-	key, err := crypto.NewECDSAKey(seed.Payload())
+	fields["memo"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "(Optional) Text memo to attach to the transaction.",
+	}
+	fields["memos"] = &framework.FieldSchema{
+		Type: framework.TypeSlice,
+		Description: "(Optional) Memos to attach to the transaction, each an object with 'type', 'format' and 'data' " +
+			"given as text, or as hex when 'encoding' is 'hex'.",
+	}
+	return fields
+}
 
-	rippleAccount, err := data.NewAccountFromAddress(account.AccountId)
-	if err != nil {
-		return nil, err
+// readTxOptions reads the signing options from the request, applying the mount's offline setting
+func readTxOptions(config *Config, d *framework.FieldData) (*txOptions, error) {
+	opts := &txOptions{
+		Offline: config.Offline,
 	}
 
-	remote, err := websockets.NewRemote("wss://s.altnet.rippletest.net:51233")
-	if err != nil {
-		return nil, err
+	if offline, ok := d.GetOk("offline"); ok {
+		opts.Offline = offline.(bool)
+	}
+
+	if sequenceRaw, ok := d.GetOk("sequence"); ok {
+		sequence, err := toUint32(sequenceRaw.(int))
+		if err != nil {
+			return nil, fmt.Errorf("sequence %s", err)
+		}
+		opts.Sequence = &sequence
 	}
 
-	accountInfo, err := remote.AccountInfo(*rippleAccount)
+	if feeRaw, ok := d.GetOk("fee"); ok {
+		drops, err := strconv.ParseInt(feeRaw.(string), 10, 64)
+		if err != nil || drops <= 0 {
+			return nil, fmt.Errorf("fee must be a positive number of drops")
+		}
+		fee, err := data.NewNativeValue(drops)
+		if err != nil {
+			return nil, err
+		}
+		opts.Fee = fee
+	}
+
+	if lastLedgerSequenceRaw, ok := d.GetOk("last_ledger_sequence"); ok {
+		lastLedgerSequence, err := toUint32(lastLedgerSequenceRaw.(int))
+		if err != nil {
+			return nil, fmt.Errorf("last_ledger_sequence %s", err)
+		}
+		opts.LastLedgerSequence = &lastLedgerSequence
+	}
+
+	var memosRaw []interface{}
+	if raw, ok := d.GetOk("memos"); ok {
+		memosRaw = raw.([]interface{})
+	}
+	memos, err := readMemos(d.Get("memo").(string), memosRaw)
 	if err != nil {
 		return nil, err
 	}
-	sequence := accountInfo.AccountData.Sequence
+	opts.Memos = memos
 
-	base := paymentTx.GetBase()
-	base.Sequence = *sequence
+	if opts.Offline && opts.Sequence == nil {
+		return nil, fmt.Errorf("sequence is required when signing offline")
+	}
+
+	return opts, nil
+}
 
-	// Sign the payment transaction
-	keySequence := uint32(0)
-	err = data.Sign(paymentTx, key, &keySequence)
+func toUint32(value int) (uint32, error) {
+	if value < 0 || uint64(value) > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("must be between 0 and %d", ^uint32(0))
+	}
+	return uint32(value), nil
+}
+
+// Sign a payment transaction
+func (b *backend) signPaymentTransaction(ctx context.Context, s logical.Storage, config *Config, account *Account, paymentTx *data.Payment, opts *txOptions) (*data.Payment, error) {
+	err := b.signTransaction(ctx, s, config, account, paymentTx, opts)
 	if err != nil {
 		return nil, err
 	}
-
 	return paymentTx, nil
 }
 
 // Sign a accountset transaction
-func signAccountSetTransaction(account *Account, accountSetTx *data.AccountSet) (*data.AccountSet, error) {
-	// Get the signer key and sequence
-	seed, err := crypto.NewRippleHashCheck(account.Secret, crypto.RIPPLE_FAMILY_SEED)
+func (b *backend) signAccountSetTransaction(ctx context.Context, s logical.Storage, config *Config, account *Account, accountSetTx *data.AccountSet, opts *txOptions) (*data.AccountSet, error) {
+	err := b.signTransaction(ctx, s, config, account, accountSetTx, opts)
 	if err != nil {
 		return nil, err
 	}
-	key, err := crypto.NewECDSAKey(seed.Payload())
+	return accountSetTx, nil
+}
 
-	rippleAccount, err := data.NewAccountFromAddress(account.AccountId)
+// Sign a trustset transaction
+func (b *backend) signTrustSetTransaction(ctx context.Context, s logical.Storage, config *Config, account *Account, trustSetTx *data.TrustSet, opts *txOptions) (*data.TrustSet, error) {
+	err := b.signTransaction(ctx, s, config, account, trustSetTx, opts)
 	if err != nil {
 		return nil, err
 	}
+	return trustSetTx, nil
+}
 
-	remote, err := websockets.NewRemote("wss://s.altnet.rippletest.net:51233")
+// Sign an accountdelete transaction
+func (b *backend) signAccountDeleteTransaction(ctx context.Context, s logical.Storage, config *Config, account *Account, accountDeleteTx *data.AccountDelete, opts *txOptions) (*data.AccountDelete, error) {
+	err := b.signTransaction(ctx, s, config, account, accountDeleteTx, opts)
 	if err != nil {
 		return nil, err
 	}
+	return accountDeleteTx, nil
+}
 
-	accountInfo, err := remote.AccountInfo(*rippleAccount)
+// Sign a setregularkey transaction
+func (b *backend) signSetRegularKeyTransaction(ctx context.Context, s logical.Storage, config *Config, account *Account, setRegularKeyTx *data.SetRegularKey, opts *txOptions) (*data.SetRegularKey, error) {
+	err := b.signTransaction(ctx, s, config, account, setRegularKeyTx, opts)
 	if err != nil {
 		return nil, err
 	}
-	sequence := accountInfo.AccountData.Sequence
+	return setRegularKeyTx, nil
+}
 
-	base := accountSetTx.GetBase()
-	base.Sequence = *sequence
+// signTransaction fills in the sequence (from opts or the ledger) and signs the transaction in place
+func (b *backend) signTransaction(ctx context.Context, s logical.Storage, config *Config, account *Account, tx data.Transaction, opts *txOptions) error {
+	if opts == nil {
+		opts = &txOptions{}
+	}
 
-	// Sign the transaction
-	keySequence := uint32(0)
-	err = data.Sign(accountSetTx, key, &keySequence)
+	// Get the signer key and sequence
+	key, keySequence, err := b.accountKey(ctx, s, account)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return accountSetTx, nil
-}
+	base := tx.GetBase()
 
-// Sign a trustset transaction
-func signTrustSetTransaction(account *Account, trustSetTx *data.TrustSet) (*data.TrustSet, error) {
-	// Get the signer key and sequence
-	seed, err := crypto.NewRippleHashCheck(account.Secret, crypto.RIPPLE_FAMILY_SEED)
-	if err != nil {
-		return nil, err
+	if opts.Sequence != nil {
+		base.Sequence = *opts.Sequence
+	} else if opts.Offline {
+		return fmt.Errorf("sequence is required when signing offline")
+	} else {
+		rippleAccount, err := data.NewAccountFromAddress(account.AccountId)
+		if err != nil {
+			return err
+		}
+
+		accountInfo, err := b.ledger(config).AccountInfo(*rippleAccount)
+		if err != nil {
+			return err
+		}
+		base.Sequence = accountInfo.Sequence
 	}
-	key, err := crypto.NewECDSAKey(seed.Payload())
 
-	rippleAccount, err := data.NewAccountFromAddress(account.AccountId)
-	if err != nil {
-		return nil, err
+	if opts.Fee != nil {
+		base.Fee = *opts.Fee
+	}
+	if opts.LastLedgerSequence != nil {
+		base.LastLedgerSequence = opts.LastLedgerSequence
+	}
+	if len(opts.Memos) > 0 {
+		base.Memos = opts.Memos
 	}
 
-	remote, err := websockets.NewRemote("wss://s.altnet.rippletest.net:51233")
+	// Sign the transaction
+	err = data.Sign(tx, key, keySequence)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	accountInfo, err := remote.AccountInfo(*rippleAccount)
-	if err != nil {
-		return nil, err
+	// Count the signatures of regular keys, which can be rotated after a number of signatures
+	if account.RegularKey != nil {
+		return b.recordKeyUsage(ctx, s, account.RegularKey.AccountId)
 	}
-	sequence := accountInfo.AccountData.Sequence
+	return nil
+}
 
-	base := trustSetTx.GetBase()
-	base.Sequence = *sequence
+// accountKey returns the signing key of an account and the key sequence to sign with. An active
+// regular key always takes precedence over the master key. Accounts imported from a raw private key
+// have no seed and are signed with the stored key directly, and accounts derived from a wallet are
+// re-derived from the wallet mnemonic.
+func (b *backend) accountKey(ctx context.Context, s logical.Storage, account *Account) (crypto.Key, *uint32, error) {
+	if account.RegularKey != nil {
+		seed, _, err := decodeFamilySeed(account.RegularKey.Secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		return seedKey(account.RegularKey.KeyType, seed)
+	}
 
-	// Sign the transaction
-	keySequence := uint32(0)
-	err = data.Sign(trustSetTx, key, &keySequence)
+	if account.Wallet != "" {
+		wallet, err := b.readWallet(ctx, s, account.Wallet)
+		if err != nil {
+			return nil, nil, err
+		}
+		if wallet == nil {
+			return nil, nil, fmt.Errorf("wallet %s of account %s not found", account.Wallet, account.AccountId)
+		}
+		key, err := wallet.deriveKey(account.WalletIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, nil, nil
+	}
+
+	if account.Secret == "" {
+		privateKey, err := crypto.NewRippleHashCheck(account.PrivateKey, crypto.RIPPLE_ACCOUNT_PRIVATE)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := parsePrivateKey(privateKey.Payload())
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, nil, nil
+	}
+
+	seed, seedKeyType, err := decodeFamilySeed(account.Secret)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	// Accounts stored without a key type, such as faucet accounts, are signed with the type of their seed
+	keyType := account.KeyType
+	if keyType == "" {
+		keyType = seedKeyType
+	}
+	return seedKey(keyType, seed)
+}
 
-	return trustSetTx, nil
+// seedKey derives the key of the given type from a family seed, along with the key sequence it is
+// used with. Ed25519 keys have no account families, so their sequence is nil.
+func seedKey(keyType string, seed []byte) (crypto.Key, *uint32, error) {
+	switch keyType {
+	case "", keyTypeSecp256k1:
+		key, err := crypto.NewECDSAKey(seed)
+		if err != nil {
+			return nil, nil, err
+		}
+		keySequenceZero := uint32(0)
+		return key, &keySequenceZero, nil
+	case keyTypeEd25519:
+		key, err := crypto.NewEd25519Key(seed)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
 }
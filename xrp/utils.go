@@ -18,15 +18,14 @@ package xrp
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/pkg/errors"
+	"github.com/rubblelabs/ripple/data"
 	"golang.org/x/crypto/ripemd160"
 	"log"
-	"math/big"
-	"regexp"
 	"sort"
 )
 
@@ -39,19 +38,6 @@ func contains(stringSlice []string, searchString string) bool {
 	return false
 }
 
-// validNumber returns a valid positive integer
-func validNumber(input string) *big.Int {
-	if input == "" {
-		return big.NewInt(0)
-	}
-	matched, err := regexp.MatchString("([0-9])", input)
-	if !matched || err != nil {
-		return nil
-	}
-	amount := math.MustParseBig256(input)
-	return amount.Abs(amount)
-}
-
 // validateFields verifies that no bad arguments were given to the request.
 func validateFields(req *logical.Request, data *framework.FieldData) error {
 	var unknownFields []string
@@ -77,6 +63,17 @@ func errMissingField(field string) *logical.Response {
 	return logical.ErrorResponse(fmt.Sprintf("Missing required field '%s'", field))
 }
 
+// parseHash256 decodes a hex encoded transaction hash
+func parseHash256(s string) (*data.Hash256, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(data.Hash256{}) {
+		return nil, fmt.Errorf("invalid hash '%s'", s)
+	}
+	var hash data.Hash256
+	copy(hash[:], b)
+	return &hash, nil
+}
+
 func sha256RipeMD160(b []byte) []byte {
 	ripe := ripemd160.New()
 	sha := sha256.New()
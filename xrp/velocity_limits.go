@@ -0,0 +1,401 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/shopspring/decimal"
+	"sort"
+	"time"
+)
+
+const (
+	// spendLedgerStoragePrefix holds the recent payments of each account with velocity limits, keyed by address
+	spendLedgerStoragePrefix = "spend_ledger/"
+
+	// Payments are only kept for this long, so no window can be longer
+	maxVelocityWindow = 31 * 24 * time.Hour
+)
+
+// VelocityLimit caps the XRP sent and the number of payments signed by an account within a rolling
+// window. A zero MaxAmount or MaxCount disables the corresponding cap.
+type VelocityLimit struct {
+	Window    time.Duration `json:"window"`
+	MaxAmount string        `json:"max_amount,omitempty"`
+	MaxCount  uint64        `json:"max_count,omitempty"`
+}
+
+// spendRecord is a payment signed by an account
+type spendRecord struct {
+	SignedAt time.Time `json:"signed_at"`
+	Currency string    `json:"currency"`
+	Issuer   string    `json:"issuer,omitempty"`
+	Amount   string    `json:"amount"`
+	TxHash   string    `json:"tx_hash"`
+}
+
+type spendLedger struct {
+	Records []*spendRecord `json:"records"`
+}
+
+// velocityUsage is the consumption of a velocity limit at a point in time
+type velocityUsage struct {
+	Amount decimal.Decimal
+	Count  uint64
+}
+
+func velocityLimitPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "accounts/" + framework.GenericNameRegex("name") + "/velocity_limits/?",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathListVelocityLimits,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/velocity_limits/" + framework.GenericNameRegex("limit"),
+			HelpSynopsis: "Limit the XRP sent or payments signed by an account within a rolling window.",
+			HelpDescription: "Payments are refused once the XRP sent within the last window, including the new payment, " +
+				"would exceed max_amount, or once max_count payments have been signed within the window. " +
+				"Payments count from the moment they are signed, whether or not they are submitted.",
+			Fields: map[string]*framework.FieldSchema{
+				"name":  &framework.FieldSchema{Type: framework.TypeString},
+				"limit": &framework.FieldSchema{Type: framework.TypeString},
+				"window": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "Length of the rolling window, e.g. 24h",
+				},
+				"max_amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum XRP sent within the window",
+				},
+				"max_count": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Maximum number of payments signed within the window",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.pathWriteVelocityLimit,
+				logical.UpdateOperation: b.pathWriteVelocityLimit,
+				logical.ReadOperation:   b.pathReadVelocityLimit,
+				logical.DeleteOperation: b.pathDeleteVelocityLimit,
+			},
+		},
+	}
+}
+
+// Lists the velocity limits of an account
+func (b *backend) pathListVelocityLimits(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	vaultAccount, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+	names := make([]string, 0, len(vaultAccount.VelocityLimits))
+	for name := range vaultAccount.VelocityLimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return logical.ListResponse(names), nil
+}
+
+// Creates or replaces a velocity limit of an account
+func (b *backend) pathWriteVelocityLimit(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	window := time.Duration(d.Get("window").(int)) * time.Second
+	if window <= 0 || window > maxVelocityWindow {
+		return logical.ErrorResponse("window must be positive and at most " + maxVelocityWindow.String()), nil
+	}
+
+	limit := &VelocityLimit{Window: window}
+	if maxAmountRaw, ok := d.GetOk("max_amount"); ok {
+		maxAmount, err := decimal.NewFromString(maxAmountRaw.(string))
+		if err != nil || maxAmount.IsNegative() {
+			return logical.ErrorResponse("max_amount is either not a number or is negative"), nil
+		}
+		limit.MaxAmount = maxAmount.String()
+	}
+	maxCount := d.Get("max_count").(int)
+	if maxCount < 0 {
+		return logical.ErrorResponse("max_count cannot be negative"), nil
+	}
+	limit.MaxCount = uint64(maxCount)
+	if (limit.MaxAmount == "" || limit.MaxAmount == "0") && limit.MaxCount == 0 {
+		return logical.ErrorResponse("one of max_amount or max_count is required"), nil
+	}
+
+	b.spendLock.Lock()
+	defer b.spendLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + d.Get("name").(string)
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+	if vaultAccount.VelocityLimits == nil {
+		vaultAccount.VelocityLimits = make(map[string]*VelocityLimit)
+	}
+	vaultAccount.VelocityLimits[d.Get("limit").(string)] = limit
+	err = b.writeVaultAccount(ctx, req, path, vaultAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.pathReadVelocityLimit(ctx, req, d)
+}
+
+// Returns a velocity limit of an account and how much of it is used
+func (b *backend) pathReadVelocityLimit(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	vaultAccount, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, nil
+	}
+	limit, ok := vaultAccount.VelocityLimits[d.Get("limit").(string)]
+	if !ok {
+		return nil, nil
+	}
+
+	ledger, err := b.readSpendLedger(ctx, req.Storage, vaultAccount.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: velocityLimitData(limit, ledger.usage(limit.Window, time.Now())),
+	}, nil
+}
+
+// Removes a velocity limit from an account. The payments already recorded are kept until they age out, so
+// removing a limit and adding it back does not reset its usage.
+func (b *backend) pathDeleteVelocityLimit(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.spendLock.Lock()
+	defer b.spendLock.Unlock()
+	b.accountLock.Lock()
+	defer b.accountLock.Unlock()
+
+	path := "accounts/" + d.Get("name").(string)
+	vaultAccount, err := b.readVaultAccount(ctx, req, path)
+	if err != nil {
+		return nil, err
+	}
+	if vaultAccount == nil {
+		return nil, nil
+	}
+	if _, ok := vaultAccount.VelocityLimits[d.Get("limit").(string)]; !ok {
+		return nil, nil
+	}
+	delete(vaultAccount.VelocityLimits, d.Get("limit").(string))
+	if len(vaultAccount.VelocityLimits) == 0 {
+		vaultAccount.VelocityLimits = nil
+	}
+	return nil, b.writeVaultAccount(ctx, req, path, vaultAccount)
+}
+
+// velocityLimitData describes a velocity limit and its usage, with the camelCase keys of account reads
+func velocityLimitData(limit *VelocityLimit, usage *velocityUsage) map[string]interface{} {
+	limitData := map[string]interface{}{
+		"window": int64(limit.Window / time.Second),
+		"amount": usage.Amount.String(),
+		"count":  usage.Count,
+	}
+	if limit.MaxAmount != "" {
+		limitData["maxAmount"] = limit.MaxAmount
+	}
+	if limit.MaxCount > 0 {
+		limitData["maxCount"] = limit.MaxCount
+	}
+	return limitData
+}
+
+// velocityLimitsData describes all velocity limits of an account for account reads
+func (b *backend) velocityLimitsData(ctx context.Context, s logical.Storage, account *Account) (map[string]interface{}, error) {
+	ledger, err := b.readSpendLedger(ctx, s, account.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	limits := make(map[string]interface{}, len(account.VelocityLimits))
+	for name, limit := range account.VelocityLimits {
+		limits[name] = velocityLimitData(limit, ledger.usage(limit.Window, now))
+	}
+	return limits, nil
+}
+
+// signLimitedPayment signs a payment after checking it against the velocity limits of the account, and
+// records it so later payments are checked against it. Accounts without velocity limits are signed as they are.
+func (b *backend) signLimitedPayment(ctx context.Context, s logical.Storage, config *Config, account *Account, payment *data.Payment, spend *spendAmount, opts *txOptions) (*data.Payment, error) {
+	var signedPayment *data.Payment
+	err := b.withVelocityLimits(ctx, s, account, spend, func() (*data.Hash256, error) {
+		var err error
+		signedPayment, err = b.signPaymentTransaction(ctx, s, config, account, payment, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &signedPayment.Hash, nil
+	})
+	return signedPayment, err
+}
+
+// signLimitedAccountDelete signs an AccountDelete sweeping spend out of the account, counting it towards the
+// velocity limits of the account like a payment
+func (b *backend) signLimitedAccountDelete(ctx context.Context, s logical.Storage, config *Config, account *Account, accountDelete *data.AccountDelete, spend *spendAmount, opts *txOptions) (*data.AccountDelete, error) {
+	var signedTx *data.AccountDelete
+	err := b.withVelocityLimits(ctx, s, account, spend, func() (*data.Hash256, error) {
+		var err error
+		signedTx, err = b.signAccountDeleteTransaction(ctx, s, config, account, accountDelete, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &signedTx.Hash, nil
+	})
+	return signedTx, err
+}
+
+// withVelocityLimits checks spend against the velocity limits of the account, calls sign to sign the
+// transaction and records it under the returned hash. Accounts without velocity limits are signed as they are.
+func (b *backend) withVelocityLimits(ctx context.Context, s logical.Storage, account *Account, spend *spendAmount, sign func() (*data.Hash256, error)) error {
+	if len(account.VelocityLimits) == 0 {
+		_, err := sign()
+		return err
+	}
+
+	// Hold the lock from the check until the transaction is recorded, so concurrent ones cannot both pass
+	b.spendLock.Lock()
+	defer b.spendLock.Unlock()
+
+	ledger, err := b.readSpendLedger(ctx, s, account.AccountId)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = checkVelocityLimits(account, ledger, spend, now)
+	if err != nil {
+		return err
+	}
+
+	txHash, err := sign()
+	if err != nil {
+		return err
+	}
+
+	ledger.Records = append(ledger.Records, &spendRecord{
+		SignedAt: now.UTC(),
+		Currency: spend.Currency,
+		Issuer:   spend.Issuer,
+		Amount:   spend.Value.String(),
+		TxHash:   txHash.String(),
+	})
+	ledger.prune(now)
+	return b.writeSpendLedger(ctx, s, account.AccountId, ledger)
+}
+
+// checkVelocityLimits refuses a payment that would take the account over any of its velocity limits
+func checkVelocityLimits(account *Account, ledger *spendLedger, spend *spendAmount, now time.Time) error {
+	names := make([]string, 0, len(account.VelocityLimits))
+	for name := range account.VelocityLimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		limit := account.VelocityLimits[name]
+		usage := ledger.usage(limit.Window, now)
+
+		if limit.MaxCount > 0 && usage.Count >= limit.MaxCount {
+			return errPolicyDenied("velocity limit %s allows %d payments per %s", name, limit.MaxCount, limit.Window)
+		}
+		if limit.MaxAmount != "" && spend.native() {
+			maxAmount, err := decimal.NewFromString(limit.MaxAmount)
+			if err != nil {
+				return err
+			}
+			if maxAmount.IsPositive() && usage.Amount.Add(spend.Value).GreaterThan(maxAmount) {
+				return errPolicyDenied("velocity limit %s allows %s XRP per %s, %s XRP has been sent",
+					name, maxAmount, limit.Window, usage.Amount)
+			}
+		}
+	}
+	return nil
+}
+
+// usage returns the XRP sent and the number of payments signed within the window ending at now
+func (l *spendLedger) usage(window time.Duration, now time.Time) *velocityUsage {
+	usage := &velocityUsage{Amount: decimal.Zero}
+	start := now.Add(-window)
+	for _, record := range l.Records {
+		if !record.SignedAt.After(start) {
+			continue
+		}
+		usage.Count++
+		if record.Currency == nativeCurrency && record.Issuer == "" {
+			amount, err := decimal.NewFromString(record.Amount)
+			if err == nil {
+				usage.Amount = usage.Amount.Add(amount)
+			}
+		}
+	}
+	return usage
+}
+
+// prune drops the payments older than any window can cover
+func (l *spendLedger) prune(now time.Time) {
+	start := now.Add(-maxVelocityWindow)
+	records := l.Records[:0]
+	for _, record := range l.Records {
+		if record.SignedAt.After(start) {
+			records = append(records, record)
+		}
+	}
+	l.Records = records
+}
+
+func (b *backend) readSpendLedger(ctx context.Context, s logical.Storage, accountId string) (*spendLedger, error) {
+	entry, err := s.Get(ctx, spendLedgerStoragePrefix+accountId)
+	if err != nil {
+		return nil, err
+	}
+	ledger := &spendLedger{}
+	if entry != nil {
+		err = entry.DecodeJSON(ledger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ledger, nil
+}
+
+func (b *backend) writeSpendLedger(ctx context.Context, s logical.Storage, accountId string, ledger *spendLedger) error {
+	entry, err := logical.StorageEntryJSON(spendLedgerStoragePrefix+accountId, ledger)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
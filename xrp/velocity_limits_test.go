@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+func TestVelocityLimits_rollingWindow(t *testing.T) {
+	now := time.Now()
+	ledger := &spendLedger{Records: []*spendRecord{
+		{SignedAt: now.Add(-40 * 24 * time.Hour), Currency: nativeCurrency, Amount: "1000"},
+		{SignedAt: now.Add(-25 * time.Hour), Currency: nativeCurrency, Amount: "100"},
+		{SignedAt: now.Add(-2 * time.Hour), Currency: nativeCurrency, Amount: "10"},
+		{SignedAt: now.Add(-30 * time.Minute), Currency: "USD", Issuer: "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", Amount: "5"},
+		{SignedAt: now.Add(-10 * time.Minute), Currency: nativeCurrency, Amount: "1.5"},
+	}}
+
+	if usage := ledger.usage(time.Hour, now); usage.Count != 2 || !usage.Amount.Equal(testDecimal("1.5")) {
+		t.Fatalf("unexpected hourly usage: %d payments, %s XRP", usage.Count, usage.Amount)
+	}
+	if usage := ledger.usage(24*time.Hour, now); usage.Count != 3 || !usage.Amount.Equal(testDecimal("11.5")) {
+		t.Fatalf("unexpected daily usage: %d payments, %s XRP", usage.Count, usage.Amount)
+	}
+
+	// Payments older than the longest window are dropped
+	ledger.prune(now)
+	if len(ledger.Records) != 4 {
+		t.Fatalf("expected the oldest payment to be pruned: %d records", len(ledger.Records))
+	}
+}
+
+func TestVelocityLimits_check(t *testing.T) {
+	now := time.Now()
+	account := &Account{VelocityLimits: map[string]*VelocityLimit{
+		"daily": {Window: 24 * time.Hour, MaxAmount: "100"},
+	}}
+	ledger := &spendLedger{Records: []*spendRecord{
+		{SignedAt: now.Add(-time.Hour), Currency: nativeCurrency, Amount: "99"},
+	}}
+
+	if err := checkVelocityLimits(account, ledger, nativeSpend(testDecimal("1")), now); err != nil {
+		t.Fatalf("expected a payment up to the limit to be allowed: %v", err)
+	}
+	if err := checkVelocityLimits(account, ledger, nativeSpend(testDecimal("1.000001")), now); err == nil {
+		t.Fatalf("expected a payment over the limit to be refused")
+	}
+	if err := checkVelocityLimits(account, ledger, nativeSpend(testDecimal("100")), now.Add(time.Hour)); err == nil {
+		t.Fatalf("expected the payment an hour ago to still count")
+	}
+	if err := checkVelocityLimits(account, ledger, nativeSpend(testDecimal("100")), now.Add(23*time.Hour+time.Minute)); err != nil {
+		t.Fatalf("expected the payment to drop out of the window: %v", err)
+	}
+}
+
+func testDecimal(s string) decimal.Decimal {
+	value, err := decimal.NewFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
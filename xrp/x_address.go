@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"math/big"
+	"strings"
+)
+
+const rippleAlphabet = "rpshnaf39wBUDNEGHJKLM4PQRST7VWXYZ2bcdeCg65jkm8oFqi1tuvAxyz"
+
+// X-addresses (XLS-5d) pack a classic address, an optional destination tag and the network into one string
+var (
+	xAddressMainnetPrefix = []byte{0x05, 0x44}
+	xAddressTestnetPrefix = []byte{0x04, 0x93}
+)
+
+const (
+	// prefix + account id + tag flag + tag
+	xAddressPayloadLength  = 2 + 20 + 1 + 8
+	xAddressChecksumLength = 4
+)
+
+// xAddress is a decoded X-address
+type xAddress struct {
+	Account data.Account
+	Tag     *uint32
+	Mainnet bool
+}
+
+// isXAddress reports whether s looks like an X-address rather than a classic address or a name
+func isXAddress(s string) bool {
+	return (strings.HasPrefix(s, "X") || strings.HasPrefix(s, "T")) && len(s) > 40
+}
+
+// decodeXAddress decodes and verifies an X-address
+func decodeXAddress(s string) (*xAddress, error) {
+	raw, err := base58Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != xAddressPayloadLength+xAddressChecksumLength {
+		return nil, fmt.Errorf("invalid X-address length")
+	}
+	payload, checksum := raw[:xAddressPayloadLength], raw[xAddressPayloadLength:]
+	if !bytes.Equal(checksum, doubleSha256(payload)[:xAddressChecksumLength]) {
+		return nil, fmt.Errorf("invalid X-address checksum")
+	}
+
+	decoded := &xAddress{}
+	switch {
+	case bytes.Equal(payload[:2], xAddressMainnetPrefix):
+		decoded.Mainnet = true
+	case bytes.Equal(payload[:2], xAddressTestnetPrefix):
+	default:
+		return nil, fmt.Errorf("invalid X-address prefix")
+	}
+	copy(decoded.Account[:], payload[2:22])
+
+	tag := binary.LittleEndian.Uint64(payload[23:])
+	switch payload[22] {
+	case 0:
+		if tag != 0 {
+			return nil, fmt.Errorf("invalid X-address tag")
+		}
+	case 1:
+		if tag > 0xFFFFFFFF {
+			return nil, fmt.Errorf("X-address tags above 32 bits are not supported")
+		}
+		tag32 := uint32(tag)
+		decoded.Tag = &tag32
+	default:
+		return nil, fmt.Errorf("invalid X-address tag flag")
+	}
+	return decoded, nil
+}
+
+// encodeXAddress encodes a classic account and optional destination tag as an X-address
+func encodeXAddress(account data.Account, tag *uint32, mainnet bool) string {
+	payload := make([]byte, 0, xAddressPayloadLength+xAddressChecksumLength)
+	if mainnet {
+		payload = append(payload, xAddressMainnetPrefix...)
+	} else {
+		payload = append(payload, xAddressTestnetPrefix...)
+	}
+	payload = append(payload, account[:]...)
+	tagBytes := make([]byte, 8)
+	if tag != nil {
+		payload = append(payload, 1)
+		binary.LittleEndian.PutUint32(tagBytes, *tag)
+	} else {
+		payload = append(payload, 0)
+	}
+	payload = append(payload, tagBytes...)
+	payload = append(payload, doubleSha256(payload)[:xAddressChecksumLength]...)
+	return base58Encode(payload)
+}
+
+func doubleSha256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func base58Decode(s string) ([]byte, error) {
+	value := new(big.Int)
+	radix := big.NewInt(int64(len(rippleAlphabet)))
+	for _, c := range s {
+		digit := strings.IndexRune(rippleAlphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(digit)))
+	}
+
+	// Leading zero digits encode leading zero bytes
+	zeros := 0
+	for zeros < len(s) && s[zeros] == rippleAlphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), value.Bytes()...), nil
+}
+
+func base58Encode(b []byte) string {
+	value := new(big.Int).SetBytes(b)
+	radix := big.NewInt(int64(len(rippleAlphabet)))
+	digit := new(big.Int)
+	var encoded []byte
+	for value.Sign() > 0 {
+		value.DivMod(value, radix, digit)
+		encoded = append(encoded, rippleAlphabet[digit.Int64()])
+	}
+	for i := 0; i < len(b) && b[i] == 0; i++ {
+		encoded = append(encoded, rippleAlphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrp
+
+import (
+	"testing"
+)
+
+func TestXAddress_decode(t *testing.T) {
+	maxTag := uint32(4294967295)
+	tests := []struct {
+		xAddress string
+		address  string
+		tag      *uint32
+		mainnet  bool
+	}{
+		{"XVLhHMPHU98es4dbozjVtdWzVrDjtV5fdx1mHp98tDMoQXb", "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", nil, true},
+		{"XVLhHMPHU98es4dbozjVtdWzVrDjtV18pX8yuPT7y4xaEHi", "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", &maxTag, true},
+		{"T719a5UwUCnEs54UsxG9CJYYDhwmFCqkr7wxCcNcfZ6p5GZ", "r9cZA1mLK5R5Am25ArfXFmqgNwjZgnfk59", nil, false},
+	}
+	for _, test := range tests {
+		decoded, err := decodeXAddress(test.xAddress)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", test.xAddress, err)
+		}
+		if decoded.Account.String() != test.address || decoded.Mainnet != test.mainnet {
+			t.Fatalf("decoded %s to %s (mainnet %v)", test.xAddress, decoded.Account.String(), decoded.Mainnet)
+		}
+		if (decoded.Tag == nil) != (test.tag == nil) || (test.tag != nil && *decoded.Tag != *test.tag) {
+			t.Fatalf("decoded the wrong tag from %s: %v", test.xAddress, decoded.Tag)
+		}
+		if encoded := encodeXAddress(decoded.Account, decoded.Tag, decoded.Mainnet); encoded != test.xAddress {
+			t.Fatalf("expected %s to encode back to itself, got %s", test.xAddress, encoded)
+		}
+	}
+}
+
+func TestXAddress_invalid(t *testing.T) {
+	for _, xAddress := range []string{
+		"XVLhHMPHU98es4dbozjVtdWzVrDjtV5fdx1mHp98tDMoQXc",
+		"XVLhHMPHU98es4dbozjVtdWzVrDjtV5fdx1mHp98tDMoQX",
+		"XVLhHMPHU98es4dbozjVtdWzVrDjtV5fdx1mHp98tDMoQX0",
+	} {
+		if _, err := decodeXAddress(xAddress); err == nil {
+			t.Fatalf("expected %s to be rejected", xAddress)
+		}
+	}
+}